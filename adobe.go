@@ -0,0 +1,387 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"unicode/utf16"
+)
+
+//
+// Adobe Swatch Exchange(.ase) and Photoshop color swatch(.aco) files. Both are big-endian binary formats.
+// See: http://www.selapa.net/swatches/colors/fileformats.php
+//
+
+const (
+	aseMagic = "ASEF"
+
+	aseGroupStart = 0xc001
+	aseGroupEnd   = 0xc002
+	aseColor      = 0x0001
+
+	aseNormal = 2 // aseNormal the color type of colors which are neither global nor spot colors
+)
+
+// SwatchExchange the contents of an Adobe Swatch Exchange(.ase) file.
+type SwatchExchange struct {
+	Colors []PaletteColor // Colors opaque IndexedColorRGBA with sequential Ids from 0, named as in the file
+	Groups []SwatchGroup  // Groups of the colors, in file order
+}
+
+// SwatchGroup A named group of colors in A swatch file.
+type SwatchGroup struct {
+	Name string // Name of the group
+	Ids  []int  // Ids of the colors in the group, in file order
+}
+
+// DecodeASE reads an Adobe Swatch Exchange file. RGB, CMYK, LAB and Gray colors are converted into RGB.
+func DecodeASE(r io.Reader) (SwatchExchange, error) {
+	var s SwatchExchange
+	br := bufio.NewReader(r)
+	var header struct {
+		Magic        [4]byte
+		Major, Minor uint16
+		Blocks       uint32
+	}
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil || string(header.Magic[:]) != aseMagic {
+		return s, errors.New("not an Adobe Swatch Exchange file")
+	}
+	if header.Major != 1 {
+		return s, fmt.Errorf("unsupported ase version %d.%d", header.Major, header.Minor)
+	}
+	var group *SwatchGroup
+	for i := uint32(0); i < header.Blocks; i++ {
+		var block struct {
+			Type   uint16
+			Length uint32
+		}
+		if err := binary.Read(br, binary.BigEndian, &block); err != nil {
+			return s, fmt.Errorf("block %d: %w", i, err)
+		}
+		data, err := readSized(br, int64(block.Length))
+		if err != nil {
+			return s, fmt.Errorf("block %d: %w", i, err)
+		}
+		switch block.Type {
+		case aseGroupStart:
+			name, _, err := aseName(data)
+			if err != nil {
+				return s, fmt.Errorf("block %d: %w", i, err)
+			}
+			s.Groups = append(s.Groups, SwatchGroup{Name: name})
+			group = &s.Groups[len(s.Groups)-1]
+		case aseGroupEnd:
+			group = nil
+		case aseColor:
+			c, err := aseEntry(data, len(s.Colors))
+			if err != nil {
+				return s, fmt.Errorf("block %d: %w", i, err)
+			}
+			s.Colors = append(s.Colors, c)
+			if group != nil {
+				group.Ids = append(group.Ids, c.Id)
+			}
+		}
+	}
+	return s, nil
+}
+
+// aseName reads A length prefixed, null terminated UTF-16 name. Returns the name and the rest of the data.
+func aseName(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < 2*n {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return utf16String(data[:2*n]), data[2*n:], nil
+}
+
+// aseEntry reads A color entry: its name, color model and values.
+func aseEntry(data []byte, id int) (IndexedColorRGBA, error) {
+	name, data, err := aseName(data)
+	if err != nil {
+		return IndexedColorRGBA{}, err
+	}
+	if len(data) < 4 {
+		return IndexedColorRGBA{}, io.ErrUnexpectedEOF
+	}
+	model, data := string(data[:4]), data[4:]
+	var values [4]float64
+	count := map[string]int{"RGB ": 3, "CMYK": 4, "LAB ": 3, "Gray": 1}[model]
+	if count == 0 {
+		return IndexedColorRGBA{}, fmt.Errorf("unsupported color model %q", model)
+	}
+	if len(data) < 4*count {
+		return IndexedColorRGBA{}, io.ErrUnexpectedEOF
+	}
+	for i := 0; i < count; i++ {
+		values[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(data[4*i:])))
+	}
+	c := IndexedColorRGBA{Id: id, Name: name}
+	switch model {
+	case "RGB ":
+		c.ColorRGBA = newOpaqueColor16(values[0], values[1], values[2])
+	case "CMYK":
+		c.ColorRGBA = cmykColor(values[0], values[1], values[2], values[3])
+	case "LAB ":
+		c.R, c.G, c.B = labToRGB(values[0]*100, values[1], values[2])
+	case "Gray":
+		c.ColorRGBA = newOpaqueColor16(values[0], values[0], values[0])
+	}
+	return c, nil
+}
+
+// EncodeASE writes the colors of the palette as an Adobe Swatch Exchange file of RGB colors.
+// Colors outside the groups are written first in the order of Indexes, followed by each group with its colors
+// in the listed order. Fails if A group lists A color which is not in the palette.
+func EncodeASE(w io.Writer, t *Palette, groups []SwatchGroup) error {
+	grouped := make(map[int]bool)
+	blocks := 0
+	for _, g := range groups {
+		for _, id := range g.Ids {
+			if _, ok := t.lookup[id]; !ok {
+				return fmt.Errorf("index %d not found in the palette", id)
+			}
+			grouped[id] = true
+		}
+		blocks += 2 + len(g.Ids)
+	}
+	var ungrouped []PaletteColor
+	for _, c := range t.colors() {
+		if !grouped[c.Index()] {
+			ungrouped = append(ungrouped, c)
+		}
+	}
+	blocks += len(ungrouped)
+
+	b := bufio.NewWriter(w)
+	_, _ = b.WriteString(aseMagic)
+	writeBigEndian(b, uint16(1), uint16(0), uint32(blocks))
+	for _, c := range ungrouped {
+		writeASEColor(b, c)
+	}
+	for _, g := range groups {
+		name := aseNameBytes(g.Name)
+		writeBigEndian(b, uint16(aseGroupStart), uint32(len(name)))
+		_, _ = b.Write(name)
+		for _, id := range g.Ids {
+			writeASEColor(b, t.lookup[id])
+		}
+		writeBigEndian(b, uint16(aseGroupEnd), uint32(0))
+	}
+	return b.Flush()
+}
+
+// writeASEColor writes A color entry block of an RGB color.
+func writeASEColor(w io.Writer, c PaletteColor) {
+	name := aseNameBytes(colorName(c))
+	writeBigEndian(w, uint16(aseColor), uint32(len(name)+4+3*4+2))
+	_, _ = w.Write(name)
+	_, _ = w.Write([]byte("RGB "))
+	for d := 0; d < 3; d++ {
+		writeBigEndian(w, float32(c.Dimension(d))/0xffff)
+	}
+	writeBigEndian(w, uint16(aseNormal))
+}
+
+// aseNameBytes encodes A length prefixed, null terminated UTF-16 name.
+func aseNameBytes(name string) []byte {
+	units := append(utf16.Encode([]rune(name)), 0)
+	data := make([]byte, 2+2*len(units))
+	binary.BigEndian.PutUint16(data, uint16(len(units)))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(data[2+2*i:], u)
+	}
+	return data
+}
+
+// Photoshop color spaces of .aco files.
+const (
+	acoRGB  = 0
+	acoHSB  = 1
+	acoCMYK = 2
+	acoLab  = 7
+	acoGray = 8
+)
+
+// DecodeACO reads A Photoshop color swatch file into opaque IndexedColorRGBA with sequential Ids from 0.
+// Colors are named if the file has A version 2 section. RGB, HSB, CMYK, Lab and Grayscale colors are converted into RGB.
+func DecodeACO(r io.Reader) ([]PaletteColor, error) {
+	br := bufio.NewReader(r)
+	var colors []PaletteColor
+	for version := uint16(1); version <= 2; version++ {
+		var header struct{ Version, Count uint16 }
+		if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+			if colors != nil && err == io.EOF {
+				return colors, nil // no version 2 section
+			}
+			return nil, errors.New("not A Photoshop color swatch file")
+		}
+		if header.Version == 2 && version == 1 {
+			version = 2 // no version 1 section
+		}
+		if header.Version != version {
+			return nil, fmt.Errorf("unexpected aco section version %d", header.Version)
+		}
+		colors = make([]PaletteColor, header.Count)
+		for i := range colors {
+			c, err := readACOColor(br, i, version == 2)
+			if err != nil {
+				return nil, fmt.Errorf("color %d: %w", i, err)
+			}
+			colors[i] = c
+		}
+	}
+	return colors, nil
+}
+
+// readACOColor reads A color entry, followed by its name if named.
+func readACOColor(r io.Reader, id int, named bool) (IndexedColorRGBA, error) {
+	var entry struct {
+		Space      uint16
+		W, X, Y, Z uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &entry); err != nil {
+		return IndexedColorRGBA{}, err
+	}
+	c := IndexedColorRGBA{Id: id}
+	switch entry.Space {
+	case acoRGB:
+		c.R, c.G, c.B = uint32(entry.W), uint32(entry.X), uint32(entry.Y)
+	case acoHSB:
+		c.ColorRGBA = hsbColor(float64(entry.W)/0xffff, float64(entry.X)/0xffff, float64(entry.Y)/0xffff)
+	case acoCMYK:
+		// 0 is 100% ink
+		c.ColorRGBA = cmykColor(1-float64(entry.W)/0xffff, 1-float64(entry.X)/0xffff,
+			1-float64(entry.Y)/0xffff, 1-float64(entry.Z)/0xffff)
+	case acoLab:
+		c.R, c.G, c.B = labToRGB(float64(entry.W)/100, float64(int16(entry.X))/100, float64(int16(entry.Y))/100)
+	case acoGray:
+		// 10000 is black
+		v := 1 - float64(entry.W)/10000
+		c.ColorRGBA = newOpaqueColor16(v, v, v)
+	default:
+		return c, fmt.Errorf("unsupported color space %d", entry.Space)
+	}
+	if named {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return c, err
+		}
+		name, err := readSized(r, 2*int64(length))
+		if err != nil {
+			return c, err
+		}
+		c.Name = utf16String(name)
+	}
+	return c, nil
+}
+
+// EncodeACO writes the colors of the palette as A Photoshop color swatch file of RGB colors, in the order of Indexes.
+// The file has A version 1 section followed by A version 2 section with the names.
+func EncodeACO(w io.Writer, t *Palette) error {
+	colors := t.colors()
+	b := bufio.NewWriter(w)
+	for version := 1; version <= 2; version++ {
+		writeBigEndian(b, uint16(version), uint16(len(colors)))
+		for _, c := range colors {
+			r, g, bl := rgbDimensions(c)
+			writeBigEndian(b, uint16(acoRGB), uint16(r), uint16(g), uint16(bl), uint16(0))
+			if version == 2 {
+				name := aseNameBytes(colorName(c))[2:]
+				writeBigEndian(b, uint32(len(name)/2))
+				_, _ = b.Write(name)
+			}
+		}
+	}
+	return b.Flush()
+}
+
+// readSized reads the next n bytes of A size read from the file, without allocating them upfront.
+func readSized(r io.Reader, n int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, n))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// utf16String decodes big-endian UTF-16 text, up to the null terminator if any.
+func utf16String(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		u := binary.BigEndian.Uint16(data[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// writeBigEndian writes the fixed size values, leaving the errors to the final flush of A buffered writer.
+func writeBigEndian(w io.Writer, values ...interface{}) {
+	for _, v := range values {
+		_ = binary.Write(w, binary.BigEndian, v)
+	}
+}
+
+// newOpaqueColor16 creates an opaque color from R,G,B values in range [0-1], keeping 16-bit precision.
+func newOpaqueColor16(r, g, b float64) ColorRGBA {
+	return ColorRGBA{
+		R: uint32(clamp(r*0xffff) + 0.5),
+		G: uint32(clamp(g*0xffff) + 0.5),
+		B: uint32(clamp(b*0xffff) + 0.5),
+	}
+}
+
+// cmykColor converts ink coverages in range [0-1] into an opaque color.
+func cmykColor(c, m, y, k float64) ColorRGBA {
+	return newOpaqueColor16((1-c)*(1-k), (1-m)*(1-k), (1-y)*(1-k))
+}
+
+// hsbColor converts hue, saturation and brightness in range [0-1] into an opaque color.
+func hsbColor(h, s, v float64) ColorRGBA {
+	h = math.Mod(h*6, 6)
+	f := h - math.Floor(h)
+	p, q, t := v*(1-s), v*(1-s*f), v*(1-s*(1-f))
+	switch int(h) {
+	case 0:
+		return newOpaqueColor16(v, t, p)
+	case 1:
+		return newOpaqueColor16(q, v, p)
+	case 2:
+		return newOpaqueColor16(p, v, t)
+	case 3:
+		return newOpaqueColor16(p, q, v)
+	case 4:
+		return newOpaqueColor16(t, p, v)
+	default:
+		return newOpaqueColor16(v, p, q)
+	}
+}
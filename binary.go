@@ -0,0 +1,358 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image/color"
+	"math"
+	"math/bits"
+)
+
+const (
+	treeMagic   = "TPKD"
+	treeVersion = 1
+
+	// flags of A node in the encoded kd-tree
+	treeLeft         = 1 << 0 // treeLeft the node has A left child
+	treeRight        = 1 << 1 // treeRight the node has A right child
+	treeAlphaChannel = 1 << 2 // treeAlphaChannel the color has alpha
+	treeOklab        = 1 << 3 // treeOklab the color is an IndexedColorOklab, otherwise an IndexedColorRGBA
+)
+
+// MarshalBinary encodes the palette as A header with the format version and the settings, followed by the nodes of
+// the kd-tree in pre-order and A CRC-32 checksum. Loading it back skips building the tree.
+// Fails if the palette has A Metric other than the built-in ones, or colors other than IndexedColorRGBA
+// and IndexedColorOklab, which are decoded as values even if they were pointers, or colors of mixed dimensions in
+// its kd-tree. Colors are encoded as they are, translucent colors of A palette without alpha included.
+// A tree left deeper than maxTreeDepth by removals is encoded rebalanced.
+func (t *Palette) MarshalBinary() ([]byte, error) {
+	metric := metricName(t.metric)
+	if metric == "" {
+		return nil, fmt.Errorf("unsupported metric %T", t.metric)
+	}
+	data := append([]byte(treeMagic), treeVersion, 0)
+	if t.alpha {
+		data[len(data)-1] = 1
+	}
+	data = append(data, byte(len(metric)))
+	data = append(data, metric...)
+	data = appendUint64(data, math.Float64bits(t.limit))
+	r, g, b, a := t.fallback.RGBA()
+	for _, v := range []uint32{r, g, b, a} {
+		data = appendUint16(data, uint16(v))
+	}
+	data = appendUint32(data, uint32(len(t.lookup)))
+	root := t.root
+	if treeDepth(root) > maxTreeDepth(len(t.lookup)) {
+		var nodes []node
+		collect(root, &nodes)
+		root = newColorTree(nodes, 0)
+	}
+	var dims int
+	if root != nil {
+		dims = root.point.N
+	}
+	data, err := appendNode(data, root, dims)
+	if err != nil {
+		return nil, err
+	}
+	return appendUint32(data, crc32.ChecksumIEEE(data)), nil
+}
+
+// appendNode appends the subtree in pre-order, whose points must have the given dimensions.
+func appendNode(data []byte, n *node, dims int) ([]byte, error) {
+	if n == nil {
+		return data, nil
+	}
+	var flags byte
+	if n.Left != nil {
+		flags |= treeLeft
+	}
+	if n.Right != nil {
+		flags |= treeRight
+	}
+	var id int
+	var name string
+	var values []byte
+	color := n.PaletteColor
+	switch c := color.(type) {
+	case *IndexedColorRGBA:
+		color = *c
+	case *IndexedColorOklab:
+		color = *c
+	}
+	switch c := color.(type) {
+	case IndexedColorRGBA:
+		id, name = c.Id, c.Name
+		for _, v := range []uint32{c.R, c.G, c.B, c.A} {
+			values = appendUint16(values, uint16(clamp16(v)))
+		}
+		if c.AlphaChannel {
+			flags |= treeAlphaChannel
+		}
+	case IndexedColorOklab:
+		id, name = c.Id, c.Name
+		flags |= treeOklab
+		for _, v := range []float64{c.L, c.A, c.B, c.Alpha} {
+			values = appendUint64(values, math.Float64bits(v))
+		}
+		if c.AlphaChannel {
+			flags |= treeAlphaChannel
+		}
+	default:
+		return nil, fmt.Errorf("unsupported color type %T", n.PaletteColor)
+	}
+	if n.point.N != dims {
+		return nil, fmt.Errorf("color %d: dimensions mismatch", id)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	data = append(data, flags)
+	data = append(data, buf[:binary.PutVarint(buf[:], int64(id))]...)
+	data = append(data, buf[:binary.PutUvarint(buf[:], uint64(len(name)))]...)
+	data = append(data, name...)
+	data = append(data, values...)
+	data, err := appendNode(data, n.Left, dims)
+	if err != nil {
+		return nil, err
+	}
+	return appendNode(data, n.Right, dims)
+}
+
+// maxTreeDepth the depth of the deepest tree of the given number of colors decoded by UnmarshalBinary.
+// Insert keeps trees within depthFactor times the depth of A balanced tree.
+func maxTreeDepth(count int) int {
+	return depthFactor*bits.Len(uint(count)) + 1
+}
+
+// treeDepth returns the number of nodes on the longest path from n down to A leaf.
+func treeDepth(n *node) int {
+	if n == nil {
+		return 0
+	}
+	left, right := treeDepth(n.Left), treeDepth(n.Right)
+	if left > right {
+		return left + 1
+	}
+	return right + 1
+}
+
+// UnmarshalBinary decodes A palette encoded by MarshalBinary, replacing the colors and the settings of the palette.
+// The fallback color is decoded as A color.RGBA64, or color.Transparent if fully transparent.
+// A cache of the palette is kept and emptied, so A palette created with WithCache loads with A cache.
+// Fails unless the nodes are ordered as A kd-tree of at most maxTreeDepth, with points of the same dimensions.
+func (t *Palette) UnmarshalBinary(data []byte) error {
+	if len(data) < 10 || string(data[:4]) != treeMagic {
+		return errors.New("not an encoded palette")
+	}
+	if data[4] != treeVersion {
+		return fmt.Errorf("unsupported palette version %d", data[4])
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return errors.New("palette checksum mismatch")
+	}
+	r := &treeReader{data: body, pos: 5}
+	alpha := r.byte() != 0
+	metric, err := metricByName(string(r.bytes(int(r.byte()))))
+	if err != nil {
+		return err
+	}
+	limit := math.Float64frombits(r.uint64())
+	var fallback color.Color = color.RGBA64{R: r.uint16(), G: r.uint16(), B: r.uint16(), A: r.uint16()}
+	if fallback == (color.RGBA64{}) {
+		fallback = color.Transparent
+	}
+	count := int(r.uint32())
+	if r.err != nil || count > len(body) { // every node takes several bytes
+		return errors.New("palette size mismatch")
+	}
+
+	d := treeDecoder{treeReader: r, metric: metric, alpha: alpha, maxDepth: maxTreeDepth(count),
+		nodes: make([]node, 0, count), lookup: make(map[int]PaletteColor, count)}
+	var root *node
+	if count > 0 {
+		var lo, hi [4]float64
+		for i := range lo {
+			lo[i], hi[i] = math.Inf(-1), math.Inf(1)
+		}
+		root = d.node(0, 1, lo, hi)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.nodes) != count || r.pos != len(body) {
+		return errors.New("palette size mismatch")
+	}
+	t.alpha, t.metric, t.limit, t.fallback = alpha, metric, limit, fallback
+	t.root, t.lookup = root, d.lookup
+	t.invalidate()
+	return nil
+}
+
+// treeDecoder decodes the nodes of A kd-tree, projecting their colors by the metric.
+type treeDecoder struct {
+	*treeReader
+	metric   Metric
+	alpha    bool
+	dims     int // dims of the points of the tree, set by the root
+	maxDepth int
+	nodes    []node // nodes backing array of the nodes, allocated at once
+	lookup   map[int]PaletteColor
+}
+
+// node decodes A subtree in pre-order, splitting on axis at the given depth. The points of the subtree must be
+// within the bounds lo and hi of every axis set by its ancestors. Returns nil once decoding failed.
+func (d *treeDecoder) node(axis, depth int, lo, hi [4]float64) *node {
+	if len(d.nodes) == cap(d.nodes) {
+		d.fail(errors.New("palette size mismatch"))
+	}
+	if depth > d.maxDepth {
+		d.fail(errors.New("palette tree too deep"))
+		return nil
+	}
+	flags := d.byte()
+	id := int(d.varint())
+	name := string(d.bytes(int(d.uvarint())))
+	var c PaletteColor
+	if flags&treeOklab != 0 {
+		o := IndexedColorOklab{Id: id, Name: name}
+		o.L, o.A, o.B, o.Alpha = d.float64(), d.float64(), d.float64(), d.float64()
+		o.AlphaChannel = flags&treeAlphaChannel != 0
+		c = o
+	} else {
+		rgba := IndexedColorRGBA{Id: id, Name: name}
+		rgba.R, rgba.G, rgba.B, rgba.A = uint32(d.uint16()), uint32(d.uint16()), uint32(d.uint16()), uint32(d.uint16())
+		rgba.AlphaChannel = flags&treeAlphaChannel != 0
+		c = rgba
+	}
+	if _, ok := d.lookup[id]; ok || id == Unmatched {
+		d.fail(fmt.Errorf("invalid or duplicate index %d", id))
+	}
+	if d.err != nil {
+		return nil
+	}
+	point := project(d.metric, c, d.alpha)
+	if d.dims == 0 {
+		d.dims = point.N
+	} else if point.N != d.dims {
+		d.fail(fmt.Errorf("color %d: dimensions mismatch", id))
+		return nil
+	}
+	for i := 0; i < point.N; i++ {
+		if !(lo[i] <= point.X[i] && point.X[i] <= hi[i]) { // NaN too
+			d.fail(fmt.Errorf("color %d: out of kd-tree order", id))
+			return nil
+		}
+	}
+	d.lookup[id] = c
+	d.nodes = append(d.nodes, node{PaletteColor: c, point: point})
+	n := &d.nodes[len(d.nodes)-1]
+	next := (axis + 1) % point.N
+	if flags&treeLeft != 0 {
+		bound := hi
+		bound[axis] = point.X[axis]
+		n.Left = d.node(next, depth+1, lo, bound)
+	}
+	if flags&treeRight != 0 {
+		bound := lo
+		bound[axis] = point.X[axis]
+		n.Right = d.node(next, depth+1, bound, hi)
+	}
+	return n
+}
+
+// treeReader reads little-endian values, keeping the first error and reading zeros after it.
+type treeReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *treeReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// bytes reads the next n bytes. Once failed, returns zeros for the fixed size values of at most 8 bytes.
+func (r *treeReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data)-r.pos {
+		r.fail(errors.New("palette size mismatch"))
+		if n < 0 || n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *treeReader) byte() byte {
+	return r.bytes(1)[0]
+}
+
+func (r *treeReader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(r.bytes(2))
+}
+
+func (r *treeReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+func (r *treeReader) uint64() uint64 {
+	return binary.LittleEndian.Uint64(r.bytes(8))
+}
+
+func (r *treeReader) float64() float64 {
+	return math.Float64frombits(r.uint64())
+}
+
+func (r *treeReader) varint() int64 {
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail(errors.New("palette size mismatch"))
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *treeReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail(errors.New("palette size mismatch"))
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	return append(data, b[:]...)
+}
+
+func appendUint64(data []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(data, b[:]...)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// cacheShards is the maximum number of independently locked parts of A lookupCache.
+const cacheShards = 16
+
+// WithCache puts A cache of up to size lookup results in front of the kd-tree, so that repeated colors
+// skip the tree search. Only ColorRGBA queries are cached, which covers Convert, ApplyPalette and Rank.
+// The cache is safe for concurrent use. See Palette.CacheStats.
+func WithCache(size int) Option {
+	return func(t *Palette) {
+		t.cache = newLookupCache(size)
+	}
+}
+
+// CacheStats is A summary of the lookup cache usage.
+type CacheStats struct {
+	Hits    uint64 // Hits is the number of lookups answered by the cache
+	Misses  uint64 // Misses is the number of lookups which went through the kd-tree
+	Entries int    // Entries is the number of cached lookup results
+}
+
+// CacheStats returns the usage of the lookup cache. Returns zero values if the palette has no cache.
+func (t *Palette) CacheStats() CacheStats {
+	if t.cache == nil {
+		return CacheStats{}
+	}
+	return t.cache.stats()
+}
+
+// lookupCache is A bounded memo of nearest neighbour searches keyed on the exact query color.
+// The size is split exactly across the shards, using fewer shards for sizes below cacheShards.
+// A full shard evicts an arbitrary entry to make room.
+type lookupCache struct {
+	hits   uint64 // hits accessed atomically, kept first for 64-bit alignment
+	misses uint64 // misses accessed atomically
+	size   int
+	shards []cacheShard
+}
+
+type cacheShard struct {
+	sync.Mutex
+	capacity int
+	entries  map[cacheKey]cacheEntry
+}
+
+// cacheKey is A query color packed into 16 bits per dimension.
+type cacheKey struct {
+	rgba uint64
+	dims int
+}
+
+type cacheEntry struct {
+	color    PaletteColor
+	distance float64
+}
+
+func newLookupCache(size int) *lookupCache {
+	if size < 1 {
+		return nil
+	}
+	n := size
+	if n > cacheShards {
+		n = cacheShards
+	}
+	c := &lookupCache{size: size, shards: make([]cacheShard, n)}
+	for i := range c.shards {
+		c.shards[i].capacity = size / n
+		if i < size%n {
+			c.shards[i].capacity++
+		}
+	}
+	c.reset()
+	return c
+}
+
+// key packs the query color into A cacheKey. Returns false for colors which cannot be cached.
+func (c *lookupCache) key(rgba ColorRGBA) (cacheKey, bool) {
+	if rgba.R > 0xffff || rgba.G > 0xffff || rgba.B > 0xffff || rgba.A > 0xffff {
+		return cacheKey{}, false
+	}
+	k := cacheKey{
+		rgba: uint64(rgba.R)<<48 | uint64(rgba.G)<<32 | uint64(rgba.B)<<16,
+		dims: rgba.Dimensions(),
+	}
+	if rgba.AlphaChannel {
+		k.rgba |= uint64(rgba.A)
+	}
+	return k, true
+}
+
+func (c *lookupCache) shard(k cacheKey) *cacheShard {
+	h := k.rgba * 0x9e3779b97f4a7c15 // spread the bits before picking A shard
+	return &c.shards[h>>32%uint64(len(c.shards))]
+}
+
+func (c *lookupCache) get(k cacheKey) (cacheEntry, bool) {
+	s := c.shard(k)
+	s.Lock()
+	e, ok := s.entries[k]
+	s.Unlock()
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return e, ok
+}
+
+func (c *lookupCache) put(k cacheKey, e cacheEntry) {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	if len(s.entries) >= s.capacity {
+		for old := range s.entries {
+			delete(s.entries, old)
+			break
+		}
+	}
+	s.entries[k] = e
+}
+
+// reset drops all the entries, which is needed whenever the palette changes.
+func (c *lookupCache) reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.entries = make(map[cacheKey]cacheEntry)
+		s.Unlock()
+	}
+}
+
+func (c *lookupCache) stats() CacheStats {
+	st := CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		st.Entries += len(s.entries)
+		s.Unlock()
+	}
+	return st
+}
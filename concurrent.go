@@ -0,0 +1,73 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"image/color"
+	"sync"
+	"sync/atomic"
+)
+
+// SyncPalette holds A Palette which can be replaced or edited while other goroutines keep using it.
+// Readers get an immutable snapshot without ever blocking, and never observe A half-built tree.
+// Writers are serialized, and edit A copy of the current snapshot before publishing it.
+type SyncPalette struct {
+	mu       sync.Mutex   // mu serializes the writers
+	snapshot atomic.Value // snapshot holds the current *Palette
+}
+
+// NewSyncPalette creates A SyncPalette publishing the given palette.
+// The palette must not be mutated directly afterwards.
+func NewSyncPalette(p *Palette) *SyncPalette {
+	s := &SyncPalette{}
+	s.snapshot.Store(p)
+	return s
+}
+
+// Load returns the current snapshot. The snapshot must not be mutated, use Edit instead.
+func (s *SyncPalette) Load() *Palette {
+	return s.snapshot.Load().(*Palette)
+}
+
+// Store replaces the current snapshot with the given palette, which must not be mutated afterwards.
+func (s *SyncPalette) Store(p *Palette) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot.Store(p)
+}
+
+// Edit applies edit onto A copy of the current snapshot and publishes the copy.
+// If edit fails, the current snapshot is kept and the error is returned.
+func (s *SyncPalette) Edit(edit func(p *Palette) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.Load().Clone()
+	if err := edit(p); err != nil {
+		return err
+	}
+	s.snapshot.Store(p)
+	return nil
+}
+
+// ConvertColor finds the closest PaletteColor from the current snapshot. See Palette.ConvertColor.
+func (s *SyncPalette) ConvertColor(p Color) PaletteColor {
+	return s.Load().ConvertColor(p)
+}
+
+// Convert converts the given color using the current snapshot, so SyncPalette can be used as A color.Model.
+func (s *SyncPalette) Convert(p color.Color) color.Color {
+	return s.Load().Convert(p)
+}
@@ -0,0 +1,432 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+// Ditherer converts an image into A paletted image, hiding the banding of A limited palette by mixing
+// the palette colors in neighbouring pixels. See Palette.Dither.
+type Ditherer interface {
+	dither(dst *image.Paletted, src image.Image, ix *indexer)
+}
+
+// ErrorDiffusion is A Ditherer pushing the conversion error of each pixel onto the neighbouring pixels yet to be converted.
+// Palette.Dither fails on kernels without weights, with A Divisor below 1 or an Offset outside the first row.
+// See: https://en.wikipedia.org/wiki/Error_diffusion
+type ErrorDiffusion struct {
+	Weights    [][]int // Weights rows of the kernel, starting with the row of the current pixel
+	Offset     int     // Offset is the column of the current pixel in the kernel
+	Divisor    int     // Divisor is the sum of the weights
+	Serpentine bool    // Serpentine scans every other row right to left, avoiding the directional artifacts
+}
+
+// Common error diffusion kernels, all with serpentine scanning.
+var (
+	FloydSteinberg = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 7}, {3, 5, 1}},
+		Offset:     1,
+		Divisor:    16,
+		Serpentine: true,
+	}
+	JarvisJudiceNinke = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 0, 7, 5}, {3, 5, 7, 5, 3}, {1, 3, 5, 3, 1}},
+		Offset:     2,
+		Divisor:    48,
+		Serpentine: true,
+	}
+	Stucki = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 0, 8, 4}, {2, 4, 8, 4, 2}, {1, 2, 4, 2, 1}},
+		Offset:     2,
+		Divisor:    42,
+		Serpentine: true,
+	}
+	// Atkinson spreads only 3/4 of the error, trading the detail in the shadows and highlights for contrast.
+	Atkinson = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 1, 1}, {1, 1, 1, 0}, {0, 1, 0, 0}},
+		Offset:     1,
+		Divisor:    8,
+		Serpentine: true,
+	}
+	Burkes = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 0, 8, 4}, {2, 4, 8, 4, 2}},
+		Offset:     2,
+		Divisor:    32,
+		Serpentine: true,
+	}
+	Sierra = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 0, 5, 3}, {2, 4, 5, 4, 2}, {0, 2, 3, 2, 0}},
+		Offset:     2,
+		Divisor:    32,
+		Serpentine: true,
+	}
+	TwoRowSierra = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 0, 4, 3}, {1, 2, 3, 2, 1}},
+		Offset:     2,
+		Divisor:    16,
+		Serpentine: true,
+	}
+	SierraLite = ErrorDiffusion{
+		Weights:    [][]int{{0, 0, 2}, {1, 1, 0}},
+		Offset:     1,
+		Divisor:    4,
+		Serpentine: true,
+	}
+)
+
+// validate checks that the kernel spreads A finite error within the rows of the kernel.
+func (k ErrorDiffusion) validate() error {
+	if len(k.Weights) == 0 || len(k.Weights[0]) == 0 {
+		return fmt.Errorf("invalid error diffusion kernel: no weights")
+	}
+	if k.Divisor <= 0 {
+		return fmt.Errorf("invalid error diffusion kernel divisor %d: expected at least 1", k.Divisor)
+	}
+	if k.Offset < 0 || k.Offset >= len(k.Weights[0]) {
+		return fmt.Errorf("invalid error diffusion kernel offset %d: expected [0-%d]", k.Offset, len(k.Weights[0])-1)
+	}
+	return nil
+}
+
+func (k ErrorDiffusion) dither(dst *image.Paletted, src image.Image, ix *indexer) {
+	b := dst.Rect
+	read := newPixelReader(src)
+	width := 0
+	for _, row := range k.Weights {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+
+	// errs holds the error pushed onto the rows covered by the kernel, padded on both sides by the width of the
+	// kernel, which is enough for any Offset within the kernel
+	errs := make([][][4]float64, len(k.Weights))
+	for i := range errs {
+		errs[i] = make([][4]float64, b.Dx()+2*width)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		dir := 1
+		if k.Serpentine && (y-b.Min.Y)%2 == 1 {
+			dir = -1
+		}
+		for i := 0; i < b.Dx(); i++ {
+			x := i
+			if dir < 0 {
+				x = b.Dx() - 1 - i
+			}
+			var c [4]float64
+			r, g, bl, a := read.at(b.Min.X+x, y)
+			for ch, v := range [4]uint32{r, g, bl, a} {
+				c[ch] = clamp(float64(v) + errs[0][x+width][ch])
+			}
+			index, v := ix.index(c)
+			dst.Pix[dst.PixOffset(b.Min.X+x, y)] = index
+
+			for dy, row := range k.Weights {
+				for j, weight := range row {
+					if weight == 0 {
+						continue
+					}
+					e := &errs[dy][x+width+(j-k.Offset)*dir]
+					for ch := range c {
+						e[ch] += (c[ch] - v[ch]) * float64(weight) / float64(k.Divisor)
+					}
+				}
+			}
+		}
+
+		// move on to the next row, reusing the buffer of the current row
+		next := errs[0]
+		for i := range next {
+			next[i] = [4]float64{}
+		}
+		errs = append(errs[1:], next)
+	}
+}
+
+// OrderedDither is A Ditherer offsetting every pixel by A threshold taken from A matrix tiled over the image.
+// Each pixel is converted on its own, so the result is stable between animation frames and tiles seamlessly.
+// See: https://en.wikipedia.org/wiki/Ordered_dithering
+type OrderedDither struct {
+	Matrix [][]float64 // Matrix thresholds in range [0-1), tiled over the image
+	Spread float64     // Spread is the range of the offsets in 16-bit units. Zero estimates it from the size of the palette.
+}
+
+// Bayer creates an OrderedDither with the n x n Bayer matrix. n must be A power of 2.
+func Bayer(n int) OrderedDither {
+	if n < 2 || n&(n-1) != 0 {
+		panic(fmt.Errorf("invalid Bayer matrix size %d: expected A power of 2", n))
+	}
+	m := [][]int{{0}}
+	for size := 1; size < n; size *= 2 {
+		next := make([][]int, 2*size)
+		for y := range next {
+			next[y] = make([]int, 2*size)
+			for x := range next[y] {
+				v := 4 * m[y%size][x%size]
+				switch {
+				case y < size && x >= size:
+					v += 2
+				case y >= size && x < size:
+					v += 3
+				case y >= size && x >= size:
+					v++
+				}
+				next[y][x] = v
+			}
+		}
+		m = next
+	}
+	return OrderedDither{Matrix: normalizeRanks(m)}
+}
+
+// BlueNoise creates an OrderedDither with A size x size blue noise texture generated by the void-and-cluster method.
+// Blue noise has no visible pattern, unlike the Bayer matrices. The same seed always generates the same texture.
+// Generating A texture takes time in the order of size^4, so reuse it across conversions.
+// See: https://en.wikipedia.org/wiki/Ordered_dithering#Void_and_cluster
+func BlueNoise(size int, seed int64) OrderedDither {
+	if size < 1 {
+		panic(fmt.Errorf("invalid blue noise size %d: expected at least 1", size))
+	}
+	n := size * size
+	rnd := rand.New(rand.NewSource(seed))
+
+	// toroidal gaussian filter, used to measure how crowded each cell is
+	const sigma = 1.5
+	filter := make([]float64, n)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := math.Min(float64(x), float64(size-x)), math.Min(float64(y), float64(size-y))
+			filter[y*size+x] = math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+		}
+	}
+	pattern := make([]bool, n)
+	energy := make([]float64, n)
+	toggle := func(pattern []bool, energy []float64, i int) {
+		pattern[i] = !pattern[i]
+		sign := 1.0
+		if !pattern[i] {
+			sign = -1
+		}
+		ix, iy := i%size, i/size
+		for j := range energy {
+			dx, dy := (j%size-ix+size)%size, (j/size-iy+size)%size
+			energy[j] += sign * filter[dy*size+dx]
+		}
+	}
+	// extreme finds the tightest cluster among the set cells, or the largest void among the others
+	extreme := func(pattern []bool, energy []float64, set bool) int {
+		best := -1
+		for i, p := range pattern {
+			if p == set && (best < 0 || set && energy[i] > energy[best] || !set && energy[i] < energy[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	// initial pattern of randomly placed points, evened out by moving the tightest cluster into the largest void.
+	// Ties between equally crowded cells can keep moving A point back and forth, so the moves are bounded.
+	ones := n / 10
+	if ones < 1 {
+		ones = 1
+	}
+	for _, i := range rnd.Perm(n)[:ones] {
+		toggle(pattern, energy, i)
+	}
+	for moves := 0; moves < 4*n; moves++ {
+		cluster := extreme(pattern, energy, true)
+		toggle(pattern, energy, cluster)
+		void := extreme(pattern, energy, false)
+		toggle(pattern, energy, void)
+		if void == cluster {
+			break
+		}
+	}
+
+	ranks := make([]int, n)
+	// rank the initial points by removing the tightest clusters one by one
+	p, e := append([]bool(nil), pattern...), append([]float64(nil), energy...)
+	for rank := ones - 1; rank >= 0; rank-- {
+		i := extreme(p, e, true)
+		toggle(p, e, i)
+		ranks[i] = rank
+	}
+	// rank the rest by filling in the largest voids one by one
+	for rank := ones; rank < n; rank++ {
+		i := extreme(pattern, energy, false)
+		toggle(pattern, energy, i)
+		ranks[i] = rank
+	}
+
+	m := make([][]int, size)
+	for y := range m {
+		m[y] = ranks[y*size : (y+1)*size]
+	}
+	return OrderedDither{Matrix: normalizeRanks(m)}
+}
+
+// normalizeRanks maps A matrix of ranks in range [0-n) into thresholds in range [0-1).
+func normalizeRanks(ranks [][]int) [][]float64 {
+	n := float64(len(ranks) * len(ranks[0]))
+	m := make([][]float64, len(ranks))
+	for y, row := range ranks {
+		m[y] = make([]float64, len(row))
+		for x, rank := range row {
+			m[y][x] = (float64(rank) + 0.5) / n
+		}
+	}
+	return m
+}
+
+func (o OrderedDither) dither(dst *image.Paletted, src image.Image, ix *indexer) {
+	if len(o.Matrix) == 0 || len(o.Matrix[0]) == 0 {
+		noDither{}.dither(dst, src, ix)
+		return
+	}
+	spread := o.Spread
+	if spread == 0 {
+		// the distance between neighbouring colors of A palette spread evenly over the RGB cube
+		spread = 0xffff / math.Max(1, math.Cbrt(float64(len(ix.palette)))-1)
+	}
+	read := newPixelReader(src)
+	h, w := len(o.Matrix), len(o.Matrix[0])
+	b := dst.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := o.Matrix[(y%h+h)%h]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			offset := (row[(x%w+w)%w] - 0.5) * spread
+			r, g, bl, a := read.at(x, y)
+			c := [4]float64{clamp(float64(r) + offset), clamp(float64(g) + offset), clamp(float64(bl) + offset), float64(a)}
+			if ix.t.alpha {
+				c[3] = clamp(c[3] + offset)
+			}
+			dst.Pix[dst.PixOffset(x, y)], _ = ix.index(c)
+		}
+	}
+}
+
+// noDither is the Ditherer converting every pixel into its closest palette color.
+type noDither struct{}
+
+func (noDither) dither(dst *image.Paletted, src image.Image, ix *indexer) {
+	pImg := newPaletted(src, ix.t)
+	b := dst.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Pix[dst.PixOffset(x, y)] = ix.position(pImg.ColorIndexAt(x, y))
+		}
+	}
+}
+
+// Dither converts the image into A paletted image using the given Ditherer, or without dithering if d is nil.
+// The palette of the image is ordered like in ToPaletted. Fails if it has more than 256 colors.
+func (t *Palette) Dither(img image.Image, d Ditherer) (*image.Paletted, error) {
+	return t.dither(img, img.Bounds(), d)
+}
+
+// dither converts the pixels of the image within r into A paletted image.
+func (t *Palette) dither(img image.Image, r image.Rectangle, d Ditherer) (*image.Paletted, error) {
+	switch k := d.(type) {
+	case ErrorDiffusion:
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+	case *ErrorDiffusion:
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+	}
+	ix, err := newIndexer(t)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		d = noDither{}
+	}
+	dst := image.NewPaletted(r, ix.palette)
+	d.dither(dst, img, ix)
+	return dst, nil
+}
+
+// indexer maps colors onto the entries of A color.Palette made of the palette colors.
+type indexer struct {
+	t         *Palette
+	palette   color.Palette // palette colors ordered by index, followed by the fallback if any
+	positions map[int]uint8 // positions of each palette index in palette
+	values    [][4]float64  // values RGBA values of each entry of palette
+	fallback  uint8         // fallback position of the fallback color
+}
+
+func newIndexer(t *Palette) (*indexer, error) {
+	indexes := t.Indexes()
+	ix := &indexer{
+		t:         t,
+		positions: make(map[int]uint8, len(indexes)),
+	}
+	for _, index := range indexes {
+		ix.positions[index] = uint8(len(ix.palette))
+		ix.palette = append(ix.palette, t.toColor(t.lookup[index]))
+	}
+	if !math.IsInf(t.limit, 1) || len(ix.palette) == 0 {
+		ix.fallback = uint8(len(ix.palette))
+		ix.palette = append(ix.palette, t.fallback)
+	}
+	if len(ix.palette) > 256 {
+		return nil, fmt.Errorf("too many colors %d: paletted images support at most 256", len(ix.palette))
+	}
+	ix.values = make([][4]float64, len(ix.palette))
+	for i, c := range ix.palette {
+		r, g, b, a := c.RGBA()
+		ix.values[i] = [4]float64{float64(r), float64(g), float64(b), float64(a)}
+	}
+	return ix, nil
+}
+
+// index finds the entry for the given RGBA values, returning its position in the color.Palette and its values.
+// Alpha is carried over as is for palettes without alpha, so it never adds up any error.
+func (ix *indexer) index(c [4]float64) (uint8, [4]float64) {
+	position := ix.position(ix.t.convertIndex(ColorRGBA{
+		R:            uint32(c[0] + 0.5),
+		G:            uint32(c[1] + 0.5),
+		B:            uint32(c[2] + 0.5),
+		A:            uint32(c[3] + 0.5),
+		AlphaChannel: ix.t.alpha,
+	}))
+	v := ix.values[position]
+	if !ix.t.alpha {
+		v[3] = c[3]
+	}
+	return position, v
+}
+
+// position returns the position of the palette index in the color.Palette, the fallback being the position of Unmatched.
+func (ix *indexer) position(index int) uint8 {
+	if index == Unmatched {
+		return ix.fallback
+	}
+	return ix.positions[index]
+}
+
+// clamp clamps A channel value into the 16-bit range.
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(0xffff, v))
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+
+package treepalette_test
+
+import (
+	"github.com/philoj/tree-palette"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTreePalette_Dither(t *testing.T) {
+	// horizontal gray gradient
+	img := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x * 4)})
+		}
+	}
+	p := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 255, 255, 7, "WHITE"),
+		treepalette.NewOpaquePaletteColor(0, 0, 0, 3, "BLACK"),
+	}, false)
+
+	kernels := map[string]treepalette.Ditherer{
+		"FloydSteinberg":    treepalette.FloydSteinberg,
+		"JarvisJudiceNinke": treepalette.JarvisJudiceNinke,
+		"Stucki":            treepalette.Stucki,
+		"Burkes":            treepalette.Burkes,
+		"Sierra":            treepalette.Sierra,
+		"TwoRowSierra":      treepalette.TwoRowSierra,
+		"SierraLite":        treepalette.SierraLite,
+		"Atkinson":          treepalette.Atkinson,
+	}
+	for name, d := range kernels {
+		t.Run(name, func(t *testing.T) {
+			dithered, err := p.Dither(img, d)
+			assert.NoError(t, err)
+			assert.Equal(t, color.Palette{p.Convert(color.Black), p.Convert(color.White)}, dithered.Palette)
+
+			// the share of white pixels in each band of columns follows the gradient
+			for band := 0; band < 64; band += 16 {
+				white := 0
+				for y := 0; y < 32; y++ {
+					for x := band; x < band+16; x++ {
+						white += int(dithered.ColorIndexAt(x, y))
+					}
+				}
+				expected := float64(band*4+30) / 255 * 16 * 32
+				tolerance := 0.06
+				if name == "Atkinson" {
+					tolerance = 0.1 // the error left out pushes the darkest and lightest bands further out
+				}
+				assert.InDelta(t, expected, white, 16*32*tolerance)
+			}
+		})
+	}
+
+	// malformed kernels
+	for _, k := range []treepalette.ErrorDiffusion{
+		{},
+		{Weights: [][]int{{}}, Divisor: 1},
+		{Weights: [][]int{{0, 1}}, Offset: 0},
+		{Weights: [][]int{{0, 1}}, Offset: 0, Divisor: -2},
+		{Weights: [][]int{{0, 1}}, Offset: 2, Divisor: 1},
+		{Weights: [][]int{{0, 1}}, Offset: -1, Divisor: 1},
+		{Weights: [][]int{{0, 1}, {1, 1, 1, 1, 1, 1, 1, 1}}, Offset: 80, Divisor: 8},
+	} {
+		_, err := p.Dither(img, k)
+		assert.Error(t, err, "%v", k)
+		_, err = p.Dither(img, &k)
+		assert.Error(t, err, "%v", k)
+	}
+	// A kernel wider than the image
+	wide := treepalette.ErrorDiffusion{Weights: [][]int{{0, 0, 0, 0, 0, 1}, make([]int, 200)}, Offset: 4, Divisor: 1}
+	wide.Weights[1][0], wide.Weights[1][199] = 1, 1
+	_, err := p.Dither(image.NewGray(image.Rect(0, 0, 3, 3)), wide)
+	assert.NoError(t, err)
+
+	plain, err := p.Dither(img, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0), plain.ColorIndexAt(10, 5))
+	assert.Equal(t, uint8(1), plain.ColorIndexAt(50, 5))
+}
+
+func TestTreePalette_OrderedDither(t *testing.T) {
+	assert.Equal(t, [][]float64{{0.5 / 4, 2.5 / 4}, {3.5 / 4, 1.5 / 4}}, treepalette.Bayer(2).Matrix)
+	assert.Panics(t, func() { treepalette.Bayer(6) })
+
+	noise := treepalette.BlueNoise(16, 1)
+	assert.Equal(t, noise, treepalette.BlueNoise(16, 1))
+	assert.Equal(t, [][]float64{{0.5}}, treepalette.BlueNoise(1, 1).Matrix)
+	assert.Panics(t, func() { treepalette.BlueNoise(0, 1) })
+	for _, d := range []treepalette.OrderedDither{treepalette.Bayer(8), noise,
+		treepalette.BlueNoise(2, 1), treepalette.BlueNoise(3, 7), treepalette.BlueNoise(4, 2)} {
+		// every threshold appears once
+		seen := make(map[float64]bool)
+		for _, row := range d.Matrix {
+			for _, v := range row {
+				seen[v] = true
+			}
+		}
+		assert.Len(t, seen, len(d.Matrix)*len(d.Matrix[0]))
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x * 4)})
+		}
+	}
+	p := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(0, 0, 0, 0, "BLACK"),
+		treepalette.NewOpaquePaletteColor(255, 255, 255, 1, "WHITE"),
+	}, false)
+	for _, d := range []treepalette.OrderedDither{treepalette.Bayer(8), noise} {
+		dithered, err := p.Dither(img, d)
+		assert.NoError(t, err)
+		for band := 0; band < 64; band += 16 {
+			white := 0
+			for y := 0; y < 64; y++ {
+				for x := band; x < band+16; x++ {
+					white += int(dithered.ColorIndexAt(x, y))
+				}
+			}
+			assert.InDelta(t, float64(band*4+30)/255*16*64, white, 16*64*0.06)
+		}
+
+		// every pixel is converted on its own, so converting A part of the image gives the same pixels
+		part, err := p.Dither(img.SubImage(image.Rect(13, 7, 50, 40)), d)
+		assert.NoError(t, err)
+		for y := 7; y < 40; y++ {
+			for x := 13; x < 50; x++ {
+				assert.Equal(t, dithered.ColorIndexAt(x, y), part.ColorIndexAt(x, y))
+			}
+		}
+	}
+}
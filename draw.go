@@ -0,0 +1,112 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+//
+// image/draw integration, e.g. for gif.Options.
+//
+
+// DrawQuantizer draw.Quantizer implementation. With A fixed Palette, picks its colors which are the most prominent
+// in the image. Without one, generates the colors from the image instead.
+type DrawQuantizer struct {
+	Palette   *Palette  // Palette if set, the fixed palette to pick the colors from.
+	Generator Generator // Generator generates the colors if Palette is nil. Defaults to MedianCut without alpha.
+}
+
+// Quantize appends the palette colors found in m onto p, most prominent first, until p is full.
+// Without A Palette, appends the colors generated from m for the rest of p.
+func (q DrawQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	if q.Palette == nil {
+		g := q.Generator
+		if g == nil {
+			g = MedianCut{}
+		}
+		for _, c := range g.Quantize(cap(p)-len(p), m) {
+			v := rgbaValues(c)
+			p = append(p, color.RGBA64{R: uint16(v[0]), G: uint16(v[1]), B: uint16(v[2]), A: uint16(v[3])})
+		}
+		return p
+	}
+	colors, count := q.Palette.Rank(m)
+	for _, c := range colors {
+		if len(p) == cap(p) {
+			return p
+		}
+		p = append(p, q.Palette.toColor(c))
+	}
+	if count[Unmatched] > 0 && len(p) < cap(p) {
+		p = append(p, q.Palette.fallback)
+	}
+	return p
+}
+
+// Drawer draw.Drawer implementation converting the source colors into the closest colors of the destination's
+// color model with the kd-tree search. The destination's color model must be A color.Palette or A *Palette,
+// otherwise the source is drawn as is.
+type Drawer struct {
+	Metric   Metric   // Metric used to find the closest colors. Defaults to EuclideanRGB.
+	Ditherer Ditherer // Ditherer if set, dithers the converted pixels. See Palette.Dither.
+}
+
+// Draw converts the pixels of src starting at sp and draws them onto r of dst.
+func (d Drawer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	// clip the rectangle to both images, the same way draw.Draw does
+	orig := r.Min
+	r = r.Intersect(dst.Bounds())
+	r = r.Intersect(src.Bounds().Add(orig.Sub(sp)))
+	if r.Empty() {
+		return
+	}
+	sp = sp.Add(r.Min.Sub(orig))
+
+	var t *Palette
+	switch m := dst.ColorModel().(type) {
+	case color.Palette:
+		var opts []Option
+		if d.Metric != nil {
+			opts = append(opts, WithMetric(d.Metric))
+		}
+		t = NewPalettedColorModel(m, true, opts...).(*Palette)
+	case *Palette:
+		t = m
+	default:
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	}
+
+	converted, err := t.dither(src, image.Rectangle{Min: sp, Max: sp.Add(r.Size())}, d.Ditherer)
+	if err != nil {
+		// too many colors for A paletted image or A malformed kernel, convert pixel by pixel instead
+		draw.Draw(dst, r, t.ApplyPalette(src), sp, draw.Src)
+		return
+	}
+	p, direct := dst.(*image.Paletted) // indexes of the colors match their positions in the palette
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			if direct {
+				p.SetColorIndex(r.Min.X+x, r.Min.Y+y, converted.ColorIndexAt(sp.X+x, sp.Y+y))
+			} else {
+				dst.Set(r.Min.X+x, r.Min.Y+y, converted.At(sp.X+x, sp.Y+y))
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+
+package treepalette_test
+
+import (
+	"bytes"
+	"github.com/philoj/tree-palette"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+func TestDrawQuantizerAndDrawer(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), G: uint8(y * 8), B: 90, A: 255})
+		}
+	}
+	p := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 211, 92, 1, "DANDELION"),
+		treepalette.NewOpaquePaletteColor(255, 130, 1, 2, "DARK ORANGE"),
+		treepalette.NewOpaquePaletteColor(199, 44, 58, 7, "BRICK RED"),
+		treepalette.NewOpaquePaletteColor(1, 128, 181, 11, "PACIFIC BLUE"),
+		treepalette.NewOpaquePaletteColor(138, 151, 71, 13, "OLD OLIVE"),
+	}, false)
+
+	// the quantizer picks the most prominent colors first
+	colors, _ := p.Rank(img)
+	quantized := treepalette.DrawQuantizer{Palette: p}.Quantize(make(color.Palette, 0, 3), img)
+	assert.Equal(t, color.Palette{p.Convert(colors[0].(color.Color)), p.Convert(colors[1].(color.Color)), p.Convert(colors[2].(color.Color))}, quantized)
+
+	// without A palette, the quantizer generates the colors
+	generated := treepalette.MedianCut{}.Quantize(3, img)
+	quantized = treepalette.DrawQuantizer{}.Quantize(append(make(color.Palette, 0, 4), color.Black), img)
+	assert.Len(t, quantized, 4)
+	assert.Equal(t, color.Black, quantized[0])
+	for i, c := range generated {
+		assert.Equal(t, color.RGBA64Model.Convert(c.(color.Color)), quantized[i+1])
+	}
+	assert.Len(t, treepalette.DrawQuantizer{Generator: treepalette.Wu{}}.Quantize(make(color.Palette, 0, 256), img), 256)
+
+	// drawing onto A paletted image matches the dithered conversion
+	dithered, err := p.Dither(img, treepalette.FloydSteinberg)
+	assert.NoError(t, err)
+	dst := image.NewPaletted(img.Bounds(), dithered.Palette)
+	treepalette.Drawer{Ditherer: treepalette.FloydSteinberg}.Draw(dst, dst.Bounds(), img, image.Point{})
+	assert.Equal(t, dithered.Pix, dst.Pix)
+
+	// drawing A part of the source onto A part of the destination
+	part := image.NewPaletted(image.Rect(0, 0, 10, 10), dithered.Palette)
+	treepalette.Drawer{}.Draw(part, image.Rect(5, 5, 20, 20), img, image.Pt(30, 20))
+	plain := p.ApplyPalette(img)
+	for y := 5; y < 10; y++ {
+		for x := 5; x < 10; x++ {
+			assert.Equal(t, plain.At(x+25, y+15), part.At(x, y))
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, gif.Encode(&buf, img, &gif.Options{
+		NumColors: 256,
+		Quantizer: treepalette.DrawQuantizer{Palette: p},
+		Drawer:    treepalette.Drawer{Ditherer: treepalette.Bayer(4)},
+	}))
+	decoded, err := gif.Decode(&buf)
+	assert.NoError(t, err)
+	for _, c := range decoded.ColorModel().(color.Palette) {
+		assert.Equal(t, color.RGBA64Model.Convert(c), color.RGBA64Model.Convert(p.Convert(c)))
+	}
+	buf.Reset()
+	assert.NoError(t, gif.Encode(&buf, img, &gif.Options{NumColors: 16, Quantizer: treepalette.DrawQuantizer{}}))
+	decoded, err = gif.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, decoded.ColorModel().(color.Palette), 16)
+	var _ draw.Drawer = treepalette.Drawer{}
+}
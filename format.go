@@ -0,0 +1,142 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Format A palette file format.
+type Format int
+
+const (
+	FormatUnknown  Format = iota // FormatUnknown content of none of the supported formats
+	FormatGPL                    // FormatGPL GIMP palette. See DecodeGPL
+	FormatASE                    // FormatASE Adobe Swatch Exchange. See DecodeASE
+	FormatACO                    // FormatACO Photoshop color swatch. See DecodeACO
+	FormatJASC                   // FormatJASC JASC-PAL. See DecodeJASC
+	FormatRIFF                   // FormatRIFF Microsoft RIFF palette. See DecodeRIFF
+	FormatPaintNET               // FormatPaintNET Paint.NET palette. See DecodePaintNET
+	FormatHex                    // FormatHex Lospec style hex list. See DecodeHex
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatGPL:
+		return "gpl"
+	case FormatASE:
+		return "ase"
+	case FormatACO:
+		return "aco"
+	case FormatJASC:
+		return "jasc"
+	case FormatRIFF:
+		return "riff"
+	case FormatPaintNET:
+		return "paint.net"
+	case FormatHex:
+		return "hex"
+	}
+	return "unknown"
+}
+
+// DetectFormat detects the format of A palette file from its content.
+func DetectFormat(data []byte) Format {
+	data = bytes.TrimPrefix(data, []byte("\uFEFF"))
+	switch {
+	case bytes.HasPrefix(data, []byte(gplMagic)):
+		return FormatGPL
+	case bytes.HasPrefix(data, []byte(aseMagic)):
+		return FormatASE
+	case bytes.HasPrefix(data, []byte(jascMagic)):
+		return FormatJASC
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "PAL ":
+		return FormatRIFF
+	case len(data) >= 2 && data[0] == 0 && (data[1] == 1 || data[1] == 2):
+		return FormatACO // text formats never start with A null byte
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text, ";"), isHex(text, 8):
+			return FormatPaintNET
+		case isHex(strings.TrimPrefix(text, "#"), 6):
+			return FormatHex
+		}
+		return FormatUnknown
+	}
+	return FormatUnknown
+}
+
+// isHex checks whether the text is A hex number of the given number of digits.
+func isHex(text string, digits int) bool {
+	if len(text) != digits {
+		return false
+	}
+	for _, c := range text {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode reads A palette file of any of the supported formats, detected from its content.
+// The colors are IndexedColorRGBA with sequential Ids from 0 in file order. The palette names and groups of .gpl and
+// .ase files are left out, see DecodeGPL and DecodeASE to read them.
+func Decode(r io.Reader) ([]PaletteColor, Format, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, FormatUnknown, err
+	}
+	f := DetectFormat(data)
+	var colors []PaletteColor
+	switch f {
+	case FormatGPL:
+		var p GIMPPalette
+		p, err = DecodeGPL(bytes.NewReader(data))
+		colors = p.Colors
+	case FormatASE:
+		var s SwatchExchange
+		s, err = DecodeASE(bytes.NewReader(data))
+		colors = s.Colors
+	case FormatACO:
+		colors, err = DecodeACO(bytes.NewReader(data))
+	case FormatJASC:
+		colors, err = DecodeJASC(bytes.NewReader(data))
+	case FormatRIFF:
+		colors, err = DecodeRIFF(bytes.NewReader(data))
+	case FormatPaintNET:
+		colors, err = DecodePaintNET(bytes.NewReader(data))
+	case FormatHex:
+		colors, err = DecodeHex(bytes.NewReader(data))
+	default:
+		err = errors.New("unknown palette format")
+	}
+	if err != nil {
+		return nil, f, err
+	}
+	return colors, f, nil
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+
+package treepalette_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/philoj/tree-palette"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// bigEndian encodes the values as A big-endian binary file.
+func bigEndian(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			b.WriteString(s)
+		} else {
+			_ = binary.Write(&b, binary.BigEndian, v)
+		}
+	}
+	return b.Bytes()
+}
+
+// utf16Name encodes A null terminated UTF-16 name, prefixed with its length as A 16-bit or else 32-bit number.
+func utf16Name(name string, short bool) []byte {
+	units := append(utf16.Encode([]rune(name)), 0)
+	if short {
+		return append(bigEndian(uint16(len(units))), bigEndian(units)...)
+	}
+	return append(bigEndian(uint32(len(units))), bigEndian(units)...)
+}
+
+func TestGPL(t *testing.T) {
+	gpl := "GIMP Palette\r\n" +
+		"Name: Brand colors\r\n" +
+		"Columns: 4\r\n" +
+		"# exported by hand\r\n" +
+		"\r\n" +
+		"255   0   0\tBrand red\r\n" +
+		"  0 128 255\tSky  blue \r\n" +
+		" 16  32  48\r\n"
+	p, err := treepalette.DecodeGPL(strings.NewReader(gpl))
+	assert.NoError(t, err)
+	assert.Equal(t, "Brand colors", p.Name)
+	assert.Equal(t, 4, p.Columns)
+	assert.Equal(t, []treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 0, "Brand red"),
+		treepalette.NewOpaquePaletteColor(0, 128, 255, 1, "Sky  blue"),
+		treepalette.NewOpaquePaletteColor(16, 32, 48, 2, ""),
+	}, p.Colors)
+
+	// round trip
+	var b bytes.Buffer
+	assert.NoError(t, treepalette.EncodeGPL(&b, treepalette.NewPalette(p.Colors, false), p.Name, p.Columns))
+	assert.Equal(t, "GIMP Palette\nName: Brand colors\nColumns: 4\n#\n"+
+		"255   0   0\tBrand red\n"+
+		"  0 128 255\tSky  blue\n"+
+		" 16  32  48\t\n", b.String())
+	decoded, err := treepalette.DecodeGPL(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, p, decoded)
+
+	// palette colors in the order of their indexes
+	b.Reset()
+	assert.NoError(t, treepalette.EncodeGPL(&b, treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(1, 2, 3, 9, "last"),
+		treepalette.NewOklabPaletteColor(1, 0, 0, 2, "white"),
+	}, false), "", 0))
+	decoded, err = treepalette.DecodeGPL(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, treepalette.GIMPPalette{Colors: []treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 255, 255, 0, "white"),
+		treepalette.NewOpaquePaletteColor(1, 2, 3, 1, "last"),
+	}}, decoded)
+
+	for _, invalid := range []string{
+		"",
+		"JASC-PAL\n",
+		"GIMP Palette\nColumns: many\n",
+		"GIMP Palette\n255 0\n",
+		"GIMP Palette\n256 0 0 too bright\n",
+	} {
+		_, err := treepalette.DecodeGPL(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestASE(t *testing.T) {
+	// aseColor encodes A color entry block.
+	aseColor := func(name, model string, values ...float32) []byte {
+		data := append(utf16Name(name, true), bigEndian(model, values, uint16(2))...)
+		return append(bigEndian(uint16(0x0001), uint32(len(data))), data...)
+	}
+	group := utf16Name("Brand ☕ 𝄞", true)
+	var file []byte
+	file = append(file, bigEndian("ASEF", uint16(1), uint16(0), uint32(7))...)
+	file = append(file, aseColor("White", "Gray", 1)...)
+	file = append(file, bigEndian(uint16(0xc001), uint32(len(group)))...)
+	file = append(file, group...)
+	file = append(file, aseColor("Red", "RGB ", 1, 0, 0)...)
+	file = append(file, aseColor("Cyan", "CMYK", 1, 0, 0, 0)...)
+	file = append(file, aseColor("Black", "LAB ", 0, 0, 0)...)
+	file = append(file, bigEndian(uint16(0xc002), uint32(0))...)
+	file = append(file, aseColor("", "RGB ", 0, 0.5, 1)...)
+
+	s, err := treepalette.DecodeASE(bytes.NewReader(file))
+	assert.NoError(t, err)
+	assert.Equal(t, []treepalette.SwatchGroup{{Name: "Brand ☕ 𝄞", Ids: []int{1, 2, 3}}}, s.Groups)
+	assert.Equal(t, []treepalette.PaletteColor{
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0xffff, G: 0xffff, B: 0xffff}, Id: 0, Name: "White"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0xffff}, Id: 1, Name: "Red"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0xffff, B: 0xffff}, Id: 2, Name: "Cyan"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{}, Id: 3, Name: "Black"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0x8000, B: 0xffff}, Id: 4},
+	}, s.Colors)
+
+	// round trip, the colors outside the groups first
+	var b bytes.Buffer
+	assert.NoError(t, treepalette.EncodeASE(&b, treepalette.NewPalette(s.Colors, false), s.Groups))
+	decoded, err := treepalette.DecodeASE(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, []treepalette.SwatchGroup{{Name: "Brand ☕ 𝄞", Ids: []int{2, 3, 4}}}, decoded.Groups)
+	assert.Equal(t, []string{"White", "", "Red", "Cyan", "Black"}, names(decoded.Colors))
+	assert.Equal(t, s.Colors[4].(treepalette.IndexedColorRGBA).ColorRGBA, decoded.Colors[1].(treepalette.IndexedColorRGBA).ColorRGBA)
+
+	assert.Error(t, treepalette.EncodeASE(&b, treepalette.NewPalette(s.Colors, false), []treepalette.SwatchGroup{{Ids: []int{5}}}))
+	_, err = treepalette.DecodeASE(bytes.NewReader(file[:len(file)-3]))
+	assert.Error(t, err)
+	_, err = treepalette.DecodeASE(strings.NewReader("GIMP Palette\n"))
+	assert.Error(t, err)
+	// huge block lengths of short files
+	_, err = treepalette.DecodeASE(bytes.NewReader(bigEndian("ASEF", uint16(1), uint16(0), uint32(1),
+		uint16(0x0001), uint32(0xffffffff))))
+	assert.Error(t, err)
+}
+
+func TestACO(t *testing.T) {
+	entries := [][5]uint16{
+		{0, 0xffff, 0, 0, 0},           // RGB red
+		{1, 0x5555, 0xffff, 0xffff, 0}, // HSB green
+		{2, 0, 0xffff, 0xffff, 0xffff}, // CMYK cyan
+		{7, 10000, 0, 0, 0},            // Lab white
+		{8, 10000, 0, 0, 0},            // Grayscale black
+		{0, 0x1234, 0x5678, 0x9abc, 0}, // RGB
+	}
+	expected := []treepalette.PaletteColor{
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0xffff}, Id: 0, Name: "Red"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0xffff}, Id: 1, Name: "Green"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0xffff, B: 0xffff}, Id: 2, Name: "Cyan"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0xffff, G: 0xffff, B: 0xffff}, Id: 3, Name: "White"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{}, Id: 4, Name: "Black"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0x1234, G: 0x5678, B: 0x9abc}, Id: 5, Name: "Ünïcode"},
+	}
+	v1 := bigEndian(uint16(1), uint16(len(entries)))
+	v2 := bigEndian(uint16(2), uint16(len(entries)))
+	for i, e := range entries {
+		v1 = append(v1, bigEndian(e)...)
+		v2 = append(v2, bigEndian(e)...)
+		v2 = append(v2, utf16Name(expected[i].(treepalette.IndexedColorRGBA).Name, false)...)
+	}
+
+	colors, err := treepalette.DecodeACO(bytes.NewReader(append(v1, v2...)))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, colors)
+
+	colors, err = treepalette.DecodeACO(bytes.NewReader(v1))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "", "", "", "", ""}, names(colors))
+
+	// round trip
+	var b bytes.Buffer
+	assert.NoError(t, treepalette.EncodeACO(&b, treepalette.NewPalette(expected, false)))
+	colors, err = treepalette.DecodeACO(bytes.NewReader(b.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, colors)
+	colors, err = treepalette.DecodeACO(bytes.NewReader(b.Bytes()[:4+10*len(entries)]))
+	assert.NoError(t, err)
+	assert.Len(t, colors, len(entries))
+
+	_, err = treepalette.DecodeACO(bytes.NewReader(v2[:len(v2)-2]))
+	assert.Error(t, err)
+	_, err = treepalette.DecodeACO(bytes.NewReader(bigEndian(uint16(1), uint16(1), [5]uint16{3})))
+	assert.Error(t, err)
+	_, err = treepalette.DecodeACO(bytes.NewReader(bigEndian(uint16(2), uint16(1), [5]uint16{}, uint32(0xffffffff))))
+	assert.Error(t, err)
+}
+
+// names returns the names of the palette colors.
+func names(colors []treepalette.PaletteColor) []string {
+	var res []string
+	for _, c := range colors {
+		res = append(res, c.(treepalette.IndexedColorRGBA).Name)
+	}
+	return res
+}
+
+func TestPixelArtFormats(t *testing.T) {
+	colors := []treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 0, ""),
+		treepalette.NewOpaquePaletteColor(0, 128, 255, 1, ""),
+		treepalette.NewOpaquePaletteColor(16, 32, 48, 2, ""),
+	}
+	palette := treepalette.NewPalette(colors, false)
+
+	jasc := "JASC-PAL\r\n0100\r\n3\r\n255 0 0\r\n0 128 255\r\n16 32 48\r\n"
+	decoded, err := treepalette.DecodeJASC(strings.NewReader(jasc))
+	assert.NoError(t, err)
+	assert.Equal(t, colors, decoded)
+	var b bytes.Buffer
+	assert.NoError(t, treepalette.EncodeJASC(&b, palette))
+	assert.Equal(t, jasc, b.String())
+
+	riff := bigEndian("RIFF", []byte{28, 0, 0, 0}, "PAL data", []byte{16, 0, 0, 0, 0, 3, 3, 0},
+		[]byte{255, 0, 0, 0, 0, 128, 255, 0, 16, 32, 48, 0})
+	decoded, err = treepalette.DecodeRIFF(bytes.NewReader(riff))
+	assert.NoError(t, err)
+	assert.Equal(t, colors, decoded)
+	// unknown chunks are skipped, with their padding
+	decoded, err = treepalette.DecodeRIFF(bytes.NewReader(append(bigEndian("RIFF", []byte{40, 0, 0, 0}, "PAL ",
+		"LIST", []byte{3, 0, 0, 0}, "abc", []byte{0}), riff[12:]...)))
+	assert.NoError(t, err)
+	assert.Equal(t, colors, decoded)
+	b.Reset()
+	assert.NoError(t, treepalette.EncodeRIFF(&b, palette))
+	assert.Equal(t, riff, b.Bytes())
+
+	hex := "ff0000\n0080ff\n102030\n"
+	decoded, err = treepalette.DecodeHex(strings.NewReader("FF0000\r\n\r\n#0080ff\r\n102030"))
+	assert.NoError(t, err)
+	assert.Equal(t, colors, decoded)
+	b.Reset()
+	assert.NoError(t, treepalette.EncodeHex(&b, palette))
+	assert.Equal(t, hex, b.String())
+
+	paintNET := "; paint.net Palette File\r\n" +
+		"; Lines that start with a semicolon are comments\r\n" +
+		"; Colors are written as 8-digit hexadecimal numbers: aarrggbb\r\n" +
+		"FFFF0000\r\nFF0080FF\r\nFF102030\r\n"
+	decoded, err = treepalette.DecodePaintNET(strings.NewReader(paintNET))
+	assert.NoError(t, err)
+	assert.Equal(t, colors, decoded)
+	b.Reset()
+	assert.NoError(t, treepalette.EncodePaintNET(&b, palette))
+	assert.Equal(t, paintNET, b.String())
+
+	// transparent colors
+	decoded, err = treepalette.DecodePaintNET(strings.NewReader("80FF0000\n00000000\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []treepalette.PaletteColor{
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0x8080, A: 0x8080, AlphaChannel: true}, Id: 0},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{AlphaChannel: true}, Id: 1},
+	}, decoded)
+	b.Reset()
+	assert.NoError(t, treepalette.EncodePaintNET(&b, treepalette.NewPalette(decoded, true)))
+	assert.True(t, strings.HasSuffix(b.String(), "\r\n80FF0000\r\n00000000\r\n"))
+
+	for _, invalid := range []string{"JASC-PAL\n0100\n2\n1 2 3\n", "JASC-PAL\n0200\n0\n", "JASC-PAL\n0100\n1\n1 2\n",
+		"JASC-PAL\n0100\n9999999999999\n"} {
+		_, err = treepalette.DecodeJASC(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+	_, err = treepalette.DecodeRIFF(bytes.NewReader(riff[:len(riff)-1]))
+	assert.Error(t, err)
+	for _, size := range [][]byte{{0xff, 0xff, 0xff, 0xff}, {0xfe, 0xff, 0xff, 0xff}} {
+		for _, id := range []string{"data", "LIST"} {
+			_, err = treepalette.DecodeRIFF(bytes.NewReader(bigEndian("RIFF", []byte{28, 0, 0, 0}, "PAL "+id, size)))
+			assert.Error(t, err, id)
+		}
+	}
+	_, err = treepalette.DecodeHex(strings.NewReader("ff0000\nred\n"))
+	assert.Error(t, err)
+	_, err = treepalette.DecodePaintNET(strings.NewReader("ff0000\n"))
+	assert.Error(t, err)
+}
+
+func TestDecodePaintNET_MixedAlpha(t *testing.T) {
+	rand.Seed(41)
+	var file strings.Builder
+	for i := 0; i < 200; i++ {
+		alpha := 0xff
+		if i%2 == 0 {
+			alpha = rand.Intn(255)
+		}
+		_, _ = fmt.Fprintf(&file, "%02X%06X\n", alpha, rand.Intn(1<<24))
+	}
+	colors, format, err := treepalette.Decode(strings.NewReader(file.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, treepalette.FormatPaintNET, format)
+	for _, c := range colors {
+		assert.Equal(t, 4, c.Dimensions())
+	}
+	assert.Equal(t, uint32(0xffff), colors[1].Dimension(3))
+
+	for _, alpha := range []bool{true, false} {
+		p := treepalette.NewPalette(colors, alpha)
+		data, err := p.MarshalBinary()
+		assert.NoError(t, err)
+		loaded := treepalette.NewPalette(nil, false)
+		assert.NoError(t, loaded.UnmarshalBinary(data))
+		for i := 0; i < 2000; i++ {
+			q := treepalette.Color(treepalette.NewOpaqueColor(rand.Intn(256), rand.Intn(256), rand.Intn(256)))
+			if alpha {
+				q = treepalette.NewTransparentColor(rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Float64())
+			}
+			all := p.WithinDistance(q, math.Inf(1))
+			assert.Len(t, all, 200)
+			assert.Equal(t, all[0].Distance, p.ConvertColorWithDistance(q).Distance, "alpha %v", alpha)
+			assert.Equal(t, all[0].Distance, loaded.ConvertColorWithDistance(q).Distance, "alpha %v", alpha)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	palette := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 0, "Red"),
+		treepalette.NewOpaquePaletteColor(0, 128, 255, 1, "Blue"),
+	}, false)
+	for format, encode := range map[treepalette.Format]func(b *bytes.Buffer) error{
+		treepalette.FormatGPL:      func(b *bytes.Buffer) error { return treepalette.EncodeGPL(b, palette, "", 0) },
+		treepalette.FormatASE:      func(b *bytes.Buffer) error { return treepalette.EncodeASE(b, palette, nil) },
+		treepalette.FormatACO:      func(b *bytes.Buffer) error { return treepalette.EncodeACO(b, palette) },
+		treepalette.FormatJASC:     func(b *bytes.Buffer) error { return treepalette.EncodeJASC(b, palette) },
+		treepalette.FormatRIFF:     func(b *bytes.Buffer) error { return treepalette.EncodeRIFF(b, palette) },
+		treepalette.FormatPaintNET: func(b *bytes.Buffer) error { return treepalette.EncodePaintNET(b, palette) },
+		treepalette.FormatHex:      func(b *bytes.Buffer) error { return treepalette.EncodeHex(b, palette) },
+	} {
+		var b bytes.Buffer
+		assert.NoError(t, encode(&b))
+		assert.Equal(t, format, treepalette.DetectFormat(b.Bytes()), format.String())
+		colors, detected, err := treepalette.Decode(&b)
+		assert.NoError(t, err, format.String())
+		assert.Equal(t, format, detected)
+		assert.Len(t, colors, 2, format.String())
+		assert.Equal(t, 1, palette.ConvertColor(colors[1]).Index(), format.String())
+	}
+
+	assert.Equal(t, treepalette.FormatPaintNET, treepalette.DetectFormat([]byte("\n\nFF102030\n")))
+	assert.Equal(t, treepalette.FormatHex, treepalette.DetectFormat([]byte("\uFEFF#102030\n")))
+	assert.Equal(t, treepalette.FormatUnknown, treepalette.DetectFormat([]byte("red\n")))
+	_, format, err := treepalette.Decode(strings.NewReader("red\n"))
+	assert.Error(t, err)
+	assert.Equal(t, treepalette.FormatUnknown, format)
+}
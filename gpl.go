@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// gplMagic the first line of A GIMP palette file.
+const gplMagic = "GIMP Palette"
+
+// GIMPPalette the contents of A GIMP palette(.gpl) file.
+type GIMPPalette struct {
+	Name    string         // Name of the palette
+	Columns int            // Columns hint for displaying the colors in A grid, 0 if not set
+	Colors  []PaletteColor // Colors opaque IndexedColorRGBA with sequential Ids from 0, named as in the file
+}
+
+// DecodeGPL reads A GIMP palette file. Comments and blank lines are skipped.
+func DecodeGPL(r io.Reader) (GIMPPalette, error) {
+	var p GIMPPalette
+	s := bufio.NewScanner(r)
+	if !s.Scan() || strings.TrimSpace(strings.TrimPrefix(s.Text(), "\uFEFF")) != gplMagic {
+		if err := s.Err(); err != nil {
+			return p, err
+		}
+		return p, errors.New("not A GIMP palette")
+	}
+	for line := 2; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "Name:"):
+			p.Name = strings.TrimSpace(strings.TrimPrefix(text, "Name:"))
+		case strings.HasPrefix(text, "Columns:"):
+			columns, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(text, "Columns:")))
+			if err != nil || columns < 0 {
+				return p, fmt.Errorf("line %d: invalid columns %q", line, text)
+			}
+			p.Columns = columns
+		default:
+			c, err := parseGPLColor(text, len(p.Colors))
+			if err != nil {
+				return p, fmt.Errorf("line %d: %w", line, err)
+			}
+			p.Colors = append(p.Colors, c)
+		}
+	}
+	return p, s.Err()
+}
+
+// parseGPLColor parses A color row of three values in range [0-255], followed by an optional name.
+func parseGPLColor(text string, id int) (IndexedColorRGBA, error) {
+	var rgb [3]int
+	rest := text
+	for i := range rgb {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		v, err := strconv.Atoi(rest[:end])
+		if err != nil || v < 0 || v > 255 {
+			return IndexedColorRGBA{}, fmt.Errorf("invalid color %q", text)
+		}
+		rgb[i], rest = v, rest[end:]
+	}
+	return NewOpaquePaletteColor(rgb[0], rgb[1], rgb[2], id, strings.TrimSpace(rest)), nil
+}
+
+// EncodeGPL writes the colors of the palette as A GIMP palette file, in the order of Indexes.
+// Alpha values are left out. columns if positive, is written as the display hint.
+func EncodeGPL(w io.Writer, t *Palette, name string, columns int) error {
+	b := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(b, "%s\nName: %s\n", gplMagic, strings.TrimSpace(name))
+	if columns > 0 {
+		_, _ = fmt.Fprintf(b, "Columns: %d\n", columns)
+	}
+	_, _ = fmt.Fprintln(b, "#")
+	for _, c := range t.colors() {
+		r, g, bl := rgb8(c)
+		_, _ = fmt.Fprintf(b, "%3d %3d %3d\t%s\n", r, g, bl, colorName(c))
+	}
+	return b.Flush()
+}
+
+// colors returns the palette colors in the order of Indexes.
+func (t *Palette) colors() []PaletteColor {
+	indexes := t.Indexes()
+	colors := make([]PaletteColor, len(indexes))
+	for i, index := range indexes {
+		colors[i] = t.lookup[index]
+	}
+	return colors
+}
+
+// rgb8 returns the 8-bit RGB values of A color.
+func rgb8(c Color) (uint8, uint8, uint8) {
+	r, g, b := rgbDimensions(c)
+	return uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)
+}
+
+// colorName returns the name of the built-in palette colors, or an empty string for the others.
+func colorName(c PaletteColor) string {
+	switch c := c.(type) {
+	case IndexedColorRGBA:
+		return c.Name
+	case IndexedColorOklab:
+		return c.Name
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// paintNETHeader the comments written at the top of A Paint.NET palette file.
+const paintNETHeader = "; paint.net Palette File\r\n" +
+	"; Lines that start with a semicolon are comments\r\n" +
+	"; Colors are written as 8-digit hexadecimal numbers: aarrggbb\r\n"
+
+// DecodePaintNET reads A Paint.NET palette(.txt) file of AARRGGBB hex colors. Lines starting with ';' are comments.
+// Colors which are not fully opaque are read as transparent colors, and then the opaque colors are read with alpha too.
+func DecodePaintNET(r io.Reader) ([]PaletteColor, error) {
+	return decodeHexLines(r, ";", 8)
+}
+
+// EncodePaintNET writes the colors of the palette as A Paint.NET palette file.
+func EncodePaintNET(w io.Writer, t *Palette) error {
+	b := bufio.NewWriter(w)
+	_, _ = b.WriteString(paintNETHeader)
+	for _, c := range t.colors() {
+		n := nrgba(c)
+		_, _ = fmt.Fprintf(b, "%02X%02X%02X%02X\r\n", n.A, n.R, n.G, n.B)
+	}
+	return b.Flush()
+}
+
+// DecodeHex reads A Lospec style hex list(.hex) of RRGGBB colors, one per line, optionally prefixed with '#'.
+func DecodeHex(r io.Reader) ([]PaletteColor, error) {
+	return decodeHexLines(r, "", 6)
+}
+
+// EncodeHex writes the colors of the palette as A Lospec style hex list. Alpha values are left out.
+func EncodeHex(w io.Writer, t *Palette) error {
+	b := bufio.NewWriter(w)
+	for _, c := range t.colors() {
+		r, g, bl := rgb8(c)
+		_, _ = fmt.Fprintf(b, "%02x%02x%02x\n", r, g, bl)
+	}
+	return b.Flush()
+}
+
+// decodeHexLines reads A hex color of the given number of digits per line, skipping blank lines and comments
+// starting with the comment prefix if any. 8 digits are read as AARRGGBB, 6 digits as RRGGBB.
+func decodeHexLines(r io.Reader, comment string, digits int) ([]PaletteColor, error) {
+	var colors []PaletteColor
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if line == 1 {
+			text = strings.TrimPrefix(text, "\uFEFF")
+		}
+		if text == "" || (comment != "" && strings.HasPrefix(text, comment)) {
+			continue
+		}
+		hex := strings.TrimPrefix(text, "#")
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != digits {
+			return nil, fmt.Errorf("line %d: invalid color %q", line, text)
+		}
+		if digits == 6 {
+			v |= 0xff000000
+		}
+		colors = append(colors, newHexColor(uint32(v), len(colors)))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return withAlpha(colors), nil
+}
+
+// withAlpha gives the opaque colors an opaque alpha value if any of the colors is transparent, so that all the
+// colors have the same dimensions in A kd-tree.
+func withAlpha(colors []PaletteColor) []PaletteColor {
+	transparent := false
+	for _, c := range colors {
+		transparent = transparent || c.(IndexedColorRGBA).AlphaChannel
+	}
+	if transparent {
+		for i, c := range colors {
+			rgba := c.(IndexedColorRGBA)
+			if !rgba.AlphaChannel {
+				rgba.A, rgba.AlphaChannel = 0xffff, true
+				colors[i] = rgba
+			}
+		}
+	}
+	return colors
+}
+
+// newHexColor creates the palette color of an AARRGGBB value, opaque unless its alpha is below 0xff.
+// See withAlpha.
+func newHexColor(argb uint32, id int) IndexedColorRGBA {
+	n := color.NRGBA{R: uint8(argb >> 16), G: uint8(argb >> 8), B: uint8(argb), A: uint8(argb >> 24)}
+	if n.A == 0xff {
+		return NewOpaquePaletteColor(int(n.R), int(n.G), int(n.B), id, "")
+	}
+	c := ColorRGBA{AlphaChannel: true}
+	c.R, c.G, c.B, c.A = n.RGBA()
+	return IndexedColorRGBA{ColorRGBA: c, Id: id}
+}
+
+// nrgba converts A color into non-alpha-premultiplied 8-bit values, opaque if it has no alpha dimension.
+func nrgba(c Color) color.NRGBA {
+	v := rgbaValues(c)
+	return color.NRGBAModel.Convert(color.RGBA64{
+		R: uint16(v[0]), G: uint16(v[1]), B: uint16(v[2]), A: uint16(v[3]),
+	}).(color.NRGBA)
+}
@@ -18,13 +18,36 @@ package treepalette
 import (
 	"image"
 	"image/color"
+	"runtime"
 	"sort"
+	"sync"
 )
 
 // paletted wraps A source image into A 'paletted' image.
 type paletted struct {
-	src image.Image // src original image
-	p   *Palette
+	src     image.Image // src original image
+	p       *Palette
+	read    pixelReader   // read reads the pixels of src
+	indexes []int         // indexes converted color indexes of the source palette, if src is an *image.Paletted
+	colors  []color.Color // colors converted colors of the source palette, if src is an *image.Paletted
+}
+
+func newPaletted(img image.Image, p *Palette) *paletted {
+	i := &paletted{
+		src:  img,
+		p:    p,
+		read: newPixelReader(img),
+	}
+	if src, ok := img.(*image.Paletted); ok && len(src.Palette) > 0 {
+		// each color of the source palette needs to be converted only once
+		i.indexes = make([]int, len(src.Palette))
+		i.colors = make([]color.Color, len(src.Palette))
+		for n, c := range src.Palette {
+			i.indexes[n] = p.convertIndex(p.rgba(c.RGBA()))
+			i.colors[n] = p.Convert(c)
+		}
+	}
+	return i
 }
 
 func (i *paletted) ColorModel() color.Model {
@@ -34,73 +57,226 @@ func (i *paletted) Bounds() image.Rectangle {
 	return i.src.Bounds()
 }
 func (i *paletted) At(x, y int) color.Color {
-	c := ColorRGBA{AlphaChannel: i.p.alpha}
-	c.R, c.G, c.B, c.A = i.src.At(x, y).RGBA()
-	return i.p.Convert(c)
+	if i.colors != nil {
+		return i.colors[i.src.(*image.Paletted).ColorIndexAt(x, y)]
+	}
+	return i.p.Convert(i.p.rgba(i.read.at(x, y)))
 }
 
 func (i *paletted) ColorIndexAt(x, y int) int {
-	c := ColorRGBA{AlphaChannel: i.p.alpha}
-	c.R, c.G, c.B, c.A = i.src.At(x, y).RGBA()
-	return i.p.ConvertColor(c).Index()
+	if i.indexes != nil {
+		return i.indexes[i.src.(*image.Paletted).ColorIndexAt(x, y)]
+	}
+	return i.p.convertIndex(i.p.rgba(i.read.at(x, y)))
+}
+
+// rgba creates the query color for the given RGBA values, keeping alpha only if the palette does.
+func (t *Palette) rgba(r, g, b, a uint32) ColorRGBA {
+	return ColorRGBA{R: r, G: g, B: b, A: a, AlphaChannel: t.alpha}
+}
+
+// convertIndex finds the index of the closest palette color, or Unmatched. Unlike ConvertColor, it never allocates
+// for the built-in metrics.
+func (t *Palette) convertIndex(c ColorRGBA) int {
+	if t.root == nil {
+		return Unmatched
+	}
+	if t.lut != nil {
+		if index, ok := t.lut.convertRGBA(c); ok {
+			return index
+		}
+	}
+	res, _ := t.nearestRGBA(c)
+	if res == nil {
+		return Unmatched
+	}
+	return res.Index()
+}
+
+// pixelFormat the layout of the pixels read by A pixelReader.
+type pixelFormat int
+
+const (
+	pixelGeneric  pixelFormat = iota // pixelGeneric pixels read through image.Image.At
+	pixelRGBA                        // pixelRGBA pixels of an *image.RGBA
+	pixelNRGBA                       // pixelNRGBA pixels of an *image.NRGBA
+	pixelGray                        // pixelGray pixels of an *image.Gray
+	pixelYCbCr                       // pixelYCbCr pixels of an *image.YCbCr
+	pixelPaletted                    // pixelPaletted pixels of an *image.Paletted
+)
+
+// pixelReader reads the RGBA values of the pixels of an image, like image.Image.At(x, y).RGBA().
+// Common concrete image types are read straight from their pixel buffers, without allocating A color.Color for
+// every pixel.
+type pixelReader struct {
+	img     image.Image
+	format  pixelFormat
+	pix     []uint8 // pix pixel buffer of the concrete image types other than image.YCbCr
+	stride  int
+	rect    image.Rectangle
+	ycbcr   *image.YCbCr
+	palette color.Palette
+}
+
+// newPixelReader creates A pixelReader for the given image.
+func newPixelReader(img image.Image) pixelReader {
+	r := pixelReader{img: img, rect: img.Bounds()}
+	switch src := img.(type) {
+	case *image.RGBA:
+		r.format, r.pix, r.stride = pixelRGBA, src.Pix, src.Stride
+	case *image.NRGBA:
+		r.format, r.pix, r.stride = pixelNRGBA, src.Pix, src.Stride
+	case *image.Gray:
+		r.format, r.pix, r.stride = pixelGray, src.Pix, src.Stride
+	case *image.YCbCr:
+		r.format, r.ycbcr = pixelYCbCr, src
+	case *image.Paletted:
+		if len(src.Palette) > 0 {
+			r.format, r.pix, r.stride, r.palette = pixelPaletted, src.Pix, src.Stride, src.Palette
+		}
+	}
+	return r
+}
+
+// at reads the pixel at (x, y). Pixels outside the bounds are read through image.Image.At.
+func (r *pixelReader) at(x, y int) (uint32, uint32, uint32, uint32) {
+	if r.format == pixelGeneric || !(image.Point{X: x, Y: y}).In(r.rect) {
+		return r.img.At(x, y).RGBA()
+	}
+	row, col := (y-r.rect.Min.Y)*r.stride, x-r.rect.Min.X
+	switch r.format {
+	case pixelRGBA:
+		s := r.pix[row+4*col : row+4*col+4 : row+4*col+4]
+		return color.RGBA{R: s[0], G: s[1], B: s[2], A: s[3]}.RGBA()
+	case pixelNRGBA:
+		s := r.pix[row+4*col : row+4*col+4 : row+4*col+4]
+		return color.NRGBA{R: s[0], G: s[1], B: s[2], A: s[3]}.RGBA()
+	case pixelGray:
+		return color.Gray{Y: r.pix[row+col]}.RGBA()
+	case pixelYCbCr:
+		return r.ycbcr.YCbCrAt(x, y).RGBA()
+	default:
+		return r.palette[r.pix[row+col]].RGBA()
+	}
 }
 
 // ApplyPalette applies the palette onto A given image and returns new image with Palette as color.Model.
+// Pixels are converted lazily on every access, see ToPaletted for converting all of them at once.
 func (t *Palette) ApplyPalette(img image.Image) image.Image {
-	return &paletted{
-		src: img,
-		p:   t,
+	return newPaletted(img, t)
+}
+
+// ToPaletted converts every pixel of the image into its closest palette color at once, returning A real
+// *image.Paletted which can be encoded as an indexed PNG or GIF.
+// The color.Palette of the image holds the palette colors in the order of Indexes, so position i holds the color
+// with index Indexes()[i], followed by the fallback color if the palette has A threshold.
+// Fails if that adds up to more than 256 colors.
+func (t *Palette) ToPaletted(img image.Image) (*image.Paletted, error) {
+	return t.Dither(img, nil)
+}
+
+// Indexes returns the indexes of all the palette colors in ascending order.
+func (t *Palette) Indexes() []int {
+	indexes := make([]int, 0, len(t.lookup))
+	for index := range t.lookup {
+		indexes = append(indexes, index)
 	}
+	sort.Ints(indexes)
+	return indexes
 }
 
 // Rank ranks the colors in the Palette based on counts of pixels of each PaletteColor in the given image.
 // Returns A rank list of colors(most occurrences first) and A map with count of pixels for each color index.
+// Unmatched pixels are left out of the rank list and counted under the Unmatched index. See WithThreshold.
 func (t *Palette) Rank(img image.Image) ([]PaletteColor, map[int]int) {
-	count := make(map[int]int)
-	var colors []PaletteColor
-	pImg := &paletted{
-		src: img,
-		p:   t,
+	return t.RankParallel(img, 1)
+}
+
+// RankByIndex ranks the colors in the Palette based on counts of pixels of each PaletteColor in the given image.
+// Returns A rank list of color indexes(most occurrences first) and A map with count of pixels for each color index.
+// Unmatched pixels are left out of the rank list and counted under the Unmatched index. See WithThreshold.
+func (t *Palette) RankByIndex(img image.Image) ([]int, map[int]int) {
+	return t.RankByIndexParallel(img, 1)
+}
+
+// RankParallel is Rank spreading the work over the given number of goroutines, each counting A band of rows.
+// workers less than 1 uses runtime.GOMAXPROCS(0) goroutines. The result is identical to Rank.
+func (t *Palette) RankParallel(img image.Image, workers int) ([]PaletteColor, map[int]int) {
+	indexes, count := t.RankByIndexParallel(img, workers)
+	colors := make([]PaletteColor, len(indexes))
+	for i, index := range indexes {
+		colors[i] = t.lookup[index]
 	}
+	return colors, count
+}
+
+// RankByIndexParallel is RankByIndex spreading the work over the given number of goroutines, each counting A band of rows.
+// workers less than 1 uses runtime.GOMAXPROCS(0) goroutines. The result is identical to RankByIndex.
+func (t *Palette) RankByIndexParallel(img image.Image, workers int) ([]int, map[int]int) {
+	pImg := newPaletted(img, t)
 	b := img.Bounds()
-	for y := 0; y < b.Dy(); y++ {
-		for x := 0; x < b.Dx(); x++ {
-			index := pImg.ColorIndexAt(x, y)
-			_, ok := count[index]
-			if !ok {
-				colors = append(colors, t.lookup[index])
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > b.Dy() {
+		workers = b.Dy()
+	}
+
+	var colors []int
+	var count map[int]int
+	if workers <= 1 {
+		colors, count = pImg.tally(b)
+	} else {
+		type band struct {
+			colors []int
+			count  map[int]int
+		}
+		bands := make([]band, workers)
+		var wg sync.WaitGroup
+		for w := range bands {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				r := b
+				r.Min.Y, r.Max.Y = b.Min.Y+b.Dy()*w/workers, b.Min.Y+b.Dy()*(w+1)/workers
+				bands[w].colors, bands[w].count = pImg.tally(r)
+			}(w)
+		}
+		wg.Wait()
+
+		// merging in the order of the bands keeps the order of first occurrences same as A single pass
+		count = make(map[int]int)
+		for _, band := range bands {
+			for _, index := range band.colors {
+				if _, ok := count[index]; !ok {
+					colors = append(colors, index)
+				}
+			}
+			for index, n := range band.count {
+				count[index] += n
 			}
-			count[index]++
 		}
 	}
-	sort.Slice(colors, func(i, j int) bool {
-		return count[colors[i].Index()] > count[colors[j].Index()]
+	sort.SliceStable(colors, func(i, j int) bool {
+		return count[colors[i]] > count[colors[j]]
 	})
 	return colors, count
 }
 
-// RankByIndex ranks the colors in the Palette based on counts of pixels of each PaletteColor in the given image.
-// Returns A rank list of color indexes(most occurrences first) and A map with count of pixels for each color index.
-func (t *Palette) RankByIndex(img image.Image) ([]int, map[int]int) {
+// tally counts the pixels of each color index within the given rectangle.
+// Returns the matched color indexes in the order of their first occurrence and the count of pixels for each index.
+func (i *paletted) tally(r image.Rectangle) ([]int, map[int]int) {
 	count := make(map[int]int)
 	var colors []int
-	pImg := &paletted{
-		src: img,
-		p:   t,
-	}
-	b := img.Bounds()
-	for y := 0; y < b.Dy(); y++ {
-		for x := 0; x < b.Dx(); x++ {
-			index := pImg.ColorIndexAt(x, y)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			index := i.ColorIndexAt(x, y)
 			_, ok := count[index]
-			if !ok {
+			if !ok && index != Unmatched {
 				colors = append(colors, index)
 			}
 			count[index]++
 		}
 	}
-	sort.Slice(colors, func(i, j int) bool {
-		return count[colors[i]] > count[colors[j]]
-	})
 	return colors, count
 }
@@ -0,0 +1,352 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+
+package treepalette_test
+
+import (
+	"bytes"
+	"github.com/philoj/tree-palette"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTreePalette_RankThreshold(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	img.Set(0, 0, color.RGBA{R: 250, A: 255})
+	img.Set(1, 0, color.RGBA{R: 255, A: 255})
+	img.Set(2, 0, color.RGBA{G: 255, A: 255})
+	img.Set(3, 0, color.RGBA{G: 250, A: 255})
+
+	fallback := color.RGBA{R: 1, G: 2, B: 3, A: 255}
+	p := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 1, "RED"),
+		treepalette.NewOpaquePaletteColor(0, 0, 255, 2, "BLUE"),
+	}, false, treepalette.WithMetric(treepalette.CIE76), treepalette.WithThreshold(10, fallback))
+
+	colors, count := p.Rank(img)
+	assert.Len(t, colors, 1)
+	assert.Equal(t, 1, colors[0].Index())
+	assert.Equal(t, map[int]int{1: 2, treepalette.Unmatched: 2}, count)
+
+	indexes, count := p.RankByIndex(img)
+	assert.Equal(t, []int{1}, indexes)
+	assert.Equal(t, 2, count[treepalette.Unmatched])
+
+	converted := p.ApplyPalette(img)
+	assert.Equal(t, color.Color(fallback), converted.At(2, 0))
+	assert.Equal(t, treepalette.Unmatched, converted.(interface{ ColorIndexAt(x, y int) int }).ColorIndexAt(3, 0))
+	assert.Nil(t, p.ConvertColor(treepalette.NewOpaqueColor(0, 255, 0)))
+}
+
+func TestTreePalette_ToPaletted(t *testing.T) {
+	rand.Seed(23)
+	img := image.NewNRGBA(image.Rect(2, 1, 50, 40))
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256)), A: 255})
+		}
+	}
+	fallback := color.RGBA{A: 255}
+	p := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 9, "RED"),
+		treepalette.NewOpaquePaletteColor(0, 255, 0, 3, "GREEN"),
+		treepalette.NewOpaquePaletteColor(0, 0, 255, 5, "BLUE"),
+	}, false, treepalette.WithThreshold(30000, fallback))
+	assert.Equal(t, []int{3, 5, 9}, p.Indexes())
+
+	paletted, err := p.ToPaletted(img)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Bounds(), paletted.Bounds())
+	assert.Len(t, paletted.Palette, 4)
+	assert.Equal(t, color.Color(fallback), paletted.Palette[3])
+
+	lazy := p.ApplyPalette(img).(interface {
+		image.Image
+		ColorIndexAt(x, y int) int
+	})
+	indexes := p.Indexes()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i := int(paletted.ColorIndexAt(x, y))
+			if i == len(indexes) {
+				assert.Equal(t, treepalette.Unmatched, lazy.ColorIndexAt(x, y))
+			} else {
+				assert.Equal(t, indexes[i], lazy.ColorIndexAt(x, y))
+			}
+			assert.Equal(t, lazy.At(x, y), paletted.At(x, y))
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, paletted))
+	decoded, err := png.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, paletted.Pix, decoded.(*image.Paletted).Pix)
+}
+
+func TestTreePalette_RankParallel(t *testing.T) {
+	rand.Seed(17)
+	img := image.NewRGBA(image.Rect(-5, 3, 60, 83))
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(rand.Intn(256)), G: uint8(x * 3), B: uint8(y * 2), A: 255})
+		}
+	}
+	p := treepalette.NewPalette(randomPalette(24, false), false)
+	colors, count := p.Rank(img)
+	total := 0
+	for _, n := range count {
+		total += n
+	}
+	assert.Equal(t, 65*80, total)
+	for _, workers := range []int{0, 2, 3, 7, 1000} {
+		c, n := p.RankParallel(img, workers)
+		assert.Equal(t, colors, c)
+		assert.Equal(t, count, n)
+	}
+}
+
+func TestTreePalette_ConcreteImageTypes(t *testing.T) {
+	rand.Seed(19)
+	r := image.Rect(2, 1, 34, 25)
+	rgba := image.NewRGBA(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(rand.Intn(256))
+	}
+	nrgba := image.NewNRGBA(r)
+	copy(nrgba.Pix, rgba.Pix)
+	gray := image.NewGray(r)
+	copy(gray.Pix, rgba.Pix)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	copy(ycbcr.Y, rgba.Pix)
+	copy(ycbcr.Cb, rgba.Pix[len(ycbcr.Y):])
+	copy(ycbcr.Cr, rgba.Pix[len(ycbcr.Y)+len(ycbcr.Cb):])
+	pal := image.NewPaletted(r, color.Palette{color.Black, color.White, color.RGBA{R: 200, A: 255}, color.Gray{Y: 100}})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(rand.Intn(len(pal.Palette)))
+	}
+
+	for _, alpha := range []bool{false, true} {
+		p := treepalette.NewPalette(randomPalette(16, alpha), alpha)
+		for _, img := range []image.Image{rgba, nrgba, gray, ycbcr, pal} {
+			generic := genericImage{img}
+			colors, count := p.Rank(img)
+			expectedColors, expectedCount := p.Rank(generic)
+			assert.Equal(t, expectedColors, colors)
+			assert.Equal(t, expectedCount, count)
+
+			// concrete image types are converted without allocating for every pixel
+			allocs := testing.AllocsPerRun(5, func() { p.Rank(img) })
+			assert.Less(t, allocs, float64(r.Dx()*r.Dy()/10))
+
+			converted, expected := p.ApplyPalette(img), p.ApplyPalette(generic)
+			for y := r.Min.Y - 1; y <= r.Max.Y; y++ {
+				for x := r.Min.X - 1; x <= r.Max.X; x++ {
+					assert.Equal(t, expected.At(x, y), converted.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// genericImage hides the concrete type of the wrapped image.
+type genericImage struct {
+	image.Image
+}
+
+func TestTreePalette_Cache(t *testing.T) {
+	rand.Seed(23)
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(4) * 80)
+	}
+	colors := randomPalette(32, true)
+	p := treepalette.NewPalette(colors, true)
+	cached := treepalette.NewPalette(colors, true, treepalette.WithCache(1000))
+
+	expectedColors, expectedCount := p.Rank(img)
+	colors2, count := cached.RankParallel(img, 4)
+	assert.Equal(t, expectedColors, colors2)
+	assert.Equal(t, expectedCount, count)
+
+	stats := cached.CacheStats()
+	assert.Equal(t, uint64(64*64), stats.Hits+stats.Misses)
+	assert.Greater(t, stats.Hits, stats.Misses)
+	assert.LessOrEqual(t, stats.Entries, 256)
+
+	// edits invalidate the cache
+	c := treepalette.NewTransparentPaletteColor(0, 0, 0, 0, 100, "CLEAR")
+	assert.NoError(t, cached.Insert(c))
+	assert.Equal(t, 0, cached.CacheStats().Entries)
+	assert.Equal(t, 100, cached.ConvertColor(treepalette.NewTransparentColor(0, 0, 0, 0)).Index())
+	assert.Equal(t, treepalette.CacheStats{}, p.CacheStats())
+
+	// the cache never holds more than its size
+	for _, size := range []int{1, 5, 16, 100} {
+		cached = treepalette.NewPalette(colors, true, treepalette.WithCache(size))
+		for i := 0; i < 2000; i++ {
+			cached.ConvertColor(randomColor(true))
+		}
+		assert.Equal(t, size, cached.CacheStats().Entries, "size %d", size)
+		q := randomColor(true)
+		cached.ConvertColor(q)
+		cached.ConvertColor(q)
+		assert.Equal(t, uint64(1), cached.CacheStats().Hits, "size %d", size)
+	}
+}
+
+func TestTreePalette_LUT(t *testing.T) {
+	rand.Seed(29)
+	colors := randomPalette(40, false)
+	for _, m := range []treepalette.Metric{treepalette.EuclideanRGB, treepalette.CIE76, treepalette.Oklab} {
+		p := treepalette.NewPalette(colors, false, treepalette.WithMetric(m), treepalette.WithThreshold(blackWhiteDistance(m)/10, nil))
+		expected := make(map[treepalette.ColorRGBA]treepalette.PaletteColor)
+		for i := 0; i < 2000; i++ {
+			c := randomColor(false)
+			expected[c] = p.ConvertColor(c)
+		}
+
+		lut, err := treepalette.NewLUT(p, 5)
+		assert.NoError(t, err)
+		data, err := lut.MarshalBinary()
+		assert.NoError(t, err)
+		loaded := &treepalette.LUT{}
+		assert.NoError(t, loaded.UnmarshalBinary(data))
+		assert.Equal(t, 5, loaded.Bits())
+		assert.NoError(t, p.UseLUT(loaded))
+		for c, e := range expected {
+			assert.Equal(t, e, p.ConvertColor(c))
+		}
+
+		data[20]++
+		assert.Error(t, loaded.UnmarshalBinary(data))
+		assert.Error(t, treepalette.NewPalette(colors[1:], false, treepalette.WithMetric(m)).UseLUT(lut))
+	}
+	_, err := treepalette.NewLUT(treepalette.NewPalette(colors, true), 5)
+	assert.Error(t, err)
+
+	// differently weighted instances of one custom metric type pick different colors, so neither gets A table
+	light, heavy := weightedRGB{blue: 1}, weightedRGB{blue: 50}
+	p := treepalette.NewPalette(colors, false, treepalette.WithMetric(light))
+	_, err = treepalette.NewLUT(p, 5)
+	assert.Error(t, err)
+	lut, err := treepalette.NewLUT(treepalette.NewPalette(colors, false), 5)
+	assert.NoError(t, err)
+	assert.Error(t, p.UseLUT(lut))
+	assert.Error(t, treepalette.NewPalette(colors, false, treepalette.WithMetric(heavy)).UseLUT(lut))
+	assert.NoError(t, p.UseLUT(nil))
+}
+
+// weightedRGB is A custom Metric weighting the blue channel, by at least 1.
+type weightedRGB struct {
+	blue float64
+}
+
+func (m weightedRGB) Project(c treepalette.Color) treepalette.Point {
+	return treepalette.EuclideanRGB.Project(c)
+}
+
+func (m weightedRGB) Distance(q, p treepalette.Point) float64 {
+	var sum float64
+	for i := 0; i < q.N && i < p.N; i++ {
+		d := q.X[i] - p.X[i]
+		if i == 2 {
+			d *= math.Sqrt(m.blue)
+		}
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+func (m weightedRGB) PlaneDistance(q treepalette.Point, plane float64, axis int) float64 {
+	return treepalette.EuclideanRGB.PlaneDistance(q, plane, axis)
+}
+
+// blackWhiteDistance returns the distance between black and white, as measured by the metric.
+func blackWhiteDistance(m treepalette.Metric) float64 {
+	return m.Distance(m.Project(treepalette.NewOpaqueColor(0, 0, 0)), m.Project(treepalette.NewOpaqueColor(255, 255, 255)))
+}
+
+// benchmarkImages creates A 256x256 image of random pixels of each concrete image type read directly, and A generic one.
+func benchmarkImages() map[string]image.Image {
+	rand.Seed(47)
+	r := image.Rect(0, 0, 256, 256)
+	rgba := image.NewRGBA(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(rand.Intn(256))
+	}
+	nrgba := image.NewNRGBA(r)
+	copy(nrgba.Pix, rgba.Pix)
+	gray := image.NewGray(r)
+	copy(gray.Pix, rgba.Pix)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	copy(ycbcr.Y, rgba.Pix)
+	copy(ycbcr.Cb, rgba.Pix[len(ycbcr.Y):])
+	copy(ycbcr.Cr, rgba.Pix[len(ycbcr.Y)+len(ycbcr.Cb):])
+	pal := image.NewPaletted(r, randomPalettedPalette(256))
+	copy(pal.Pix, rgba.Pix)
+	return map[string]image.Image{
+		"RGBA": rgba, "NRGBA": nrgba, "Gray": gray, "YCbCr": ycbcr, "Paletted": pal, "Generic": genericImage{rgba},
+	}
+}
+
+// randomPalettedPalette creates A color.Palette of n random opaque colors.
+func randomPalettedPalette(n int) color.Palette {
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.RGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256)), A: 255}
+	}
+	return p
+}
+
+func benchmarkRank(b *testing.B, kind string) {
+	img := benchmarkImages()[kind]
+	p := treepalette.NewPalette(randomPalette(64, false), false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Rank(img)
+	}
+}
+
+func BenchmarkTreePalette_RankRGBA(b *testing.B) {
+	benchmarkRank(b, "RGBA")
+}
+
+func BenchmarkTreePalette_RankNRGBA(b *testing.B) {
+	benchmarkRank(b, "NRGBA")
+}
+
+func BenchmarkTreePalette_RankGray(b *testing.B) {
+	benchmarkRank(b, "Gray")
+}
+
+func BenchmarkTreePalette_RankYCbCr(b *testing.B) {
+	benchmarkRank(b, "YCbCr")
+}
+
+func BenchmarkTreePalette_RankPaletted(b *testing.B) {
+	benchmarkRank(b, "Paletted")
+}
+
+func BenchmarkTreePalette_RankGeneric(b *testing.B) {
+	benchmarkRank(b, "Generic")
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//
+// JSON schema of palettes, also read and written as YAML with the same field names:
+//
+//	{
+//	  "version": 1,                      // optional, 1 is the only version
+//	  "name": "Brand",                   // optional
+//	  "alpha": false,                    // whether the palette has alpha, see NewPalette
+//	  "metric": "oklab",                 // optional, one of euclidean-rgb(default), cie76, cie94, ciede2000, oklab
+//	  "metadata": {"owner": "design"},   // optional, string values
+//	  "colors": [
+//	    {"id": 0, "name": "Red", "color": "#FF0000", "metadata": {"pantone": "485 C"}},
+//	    {"id": 1, "color": "#0080FF80"}  // name and metadata are optional, color is #RRGGBB or #RRGGBBAA
+//	  ]
+//	}
+//
+// Hex colors are not alpha-premultiplied. Colors of palettes without alpha are written as #RRGGBB, and #RRGGBB colors
+// of palettes with alpha are read as fully opaque.
+//
+
+// jsonVersion the version of the palette schema.
+const jsonVersion = 1
+
+// PaletteFile A palette in the JSON schema, tagged for YAML too.
+type PaletteFile struct {
+	Version  int               `json:"version,omitempty" yaml:"version,omitempty"`
+	Name     string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Alpha    bool              `json:"alpha" yaml:"alpha"`
+	Metric   string            `json:"metric,omitempty" yaml:"metric,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Colors   []PaletteEntry    `json:"colors" yaml:"colors"`
+}
+
+// PaletteEntry A color of A PaletteFile.
+type PaletteEntry struct {
+	Id       int               `json:"id" yaml:"id"`
+	Name     string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Color    string            `json:"color" yaml:"color"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// NewPaletteFile creates the PaletteFile of A palette, with its colors in the order of Indexes.
+// The metric is left out if it is not one of the built-in metrics.
+func NewPaletteFile(t *Palette, name string) PaletteFile {
+	f := PaletteFile{Version: jsonVersion, Name: name, Alpha: t.alpha, Metric: metricName(t.metric)}
+	f.Colors = make([]PaletteEntry, 0, len(t.lookup))
+	for _, c := range t.colors() {
+		v := rgbaValues(c)
+		rgba := ColorRGBA{R: uint32(v[0]), G: uint32(v[1]), B: uint32(v[2]), A: uint32(v[3]), AlphaChannel: t.alpha}
+		f.Colors = append(f.Colors, PaletteEntry{Id: c.Index(), Name: colorName(c), Color: hexColor(rgba)})
+	}
+	return f
+}
+
+// Palette validates the file and builds its palette of IndexedColorRGBA, with the metric of the file followed by
+// the given options. Fails on unknown versions and metrics, invalid colors and duplicate ids.
+func (f PaletteFile) Palette(opts ...Option) (*Palette, error) {
+	if f.Version != 0 && f.Version != jsonVersion {
+		return nil, fmt.Errorf("unsupported palette version %d", f.Version)
+	}
+	m, err := metricByName(f.Metric)
+	if err != nil {
+		return nil, err
+	}
+	colors := make([]PaletteColor, len(f.Colors))
+	ids := make(map[int]bool, len(f.Colors))
+	for i, e := range f.Colors {
+		if e.Id == Unmatched || ids[e.Id] {
+			return nil, fmt.Errorf("color %d: invalid or duplicate id %d", i, e.Id)
+		}
+		ids[e.Id] = true
+		rgba, err := parseHexColor(e.Color)
+		if err != nil {
+			return nil, fmt.Errorf("color %d: %w", i, err)
+		}
+		c := IndexedColorRGBA{ColorRGBA: rgba, Id: e.Id, Name: e.Name}
+		if f.Alpha && !c.AlphaChannel {
+			// #RRGGBB is opaque. Every color needs alpha, or the kd-tree would mix points of 3 and 4 dimensions
+			c.A, c.AlphaChannel = 0xffff, true
+		} else if !f.Alpha {
+			c = IndexedColorRGBA{ColorRGBA: c.opaque(), Id: e.Id, Name: e.Name}
+		}
+		colors[i] = c
+	}
+	return NewPalette(colors, f.Alpha, append([]Option{WithMetric(m)}, opts...)...), nil
+}
+
+// LoadJSON reads A palette in the JSON schema, rejecting unknown fields. See PaletteFile.Palette.
+func LoadJSON(r io.Reader, opts ...Option) (*Palette, error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	var f PaletteFile
+	if err := d.Decode(&f); err != nil {
+		return nil, err
+	}
+	return f.Palette(opts...)
+}
+
+// LoadYAML reads A palette in the YAML form of the JSON schema, rejecting unknown fields. See PaletteFile.Palette.
+func LoadYAML(r io.Reader, opts ...Option) (*Palette, error) {
+	d := yaml.NewDecoder(r)
+	d.KnownFields(true)
+	var f PaletteFile
+	if err := d.Decode(&f); err != nil {
+		return nil, err
+	}
+	return f.Palette(opts...)
+}
+
+// MarshalJSON encodes the palette in the JSON schema, without A name. See NewPaletteFile.
+func (t *Palette) MarshalJSON() ([]byte, error) {
+	return json.Marshal(NewPaletteFile(t, ""))
+}
+
+// MarshalYAML encodes the palette in the YAML form of the JSON schema, without A name. See NewPaletteFile.
+func (t *Palette) MarshalYAML() (interface{}, error) {
+	return NewPaletteFile(t, ""), nil
+}
+
+// hexColor encodes the color as #RRGGBB, or #RRGGBBAA if it has alpha, not alpha-premultiplied.
+func hexColor(c ColorRGBA) string {
+	n := nrgba(c)
+	if c.AlphaChannel {
+		return fmt.Sprintf("#%02X%02X%02X%02X", n.R, n.G, n.B, n.A)
+	}
+	return fmt.Sprintf("#%02X%02X%02X", n.R, n.G, n.B)
+}
+
+// parseHexColor decodes A color encoded by hexColor, with or without the '#'. #RRGGBBAA colors have alpha.
+func parseHexColor(text string) (ColorRGBA, error) {
+	hex := strings.TrimPrefix(text, "#")
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || (len(hex) != 6 && len(hex) != 8) {
+		return ColorRGBA{}, fmt.Errorf("invalid hex color %q", text)
+	}
+	if len(hex) == 6 {
+		return NewOpaqueColor(int(v>>16), int(v>>8&0xff), int(v&0xff)), nil
+	}
+	c := ColorRGBA{AlphaChannel: true}
+	c.R, c.G, c.B, c.A = color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}.RGBA()
+	return c, nil
+}
+
+// opaque returns the color without its alpha, un-premultiplied.
+func (c ColorRGBA) opaque() ColorRGBA {
+	if !c.AlphaChannel {
+		return c
+	}
+	n := nrgba(c)
+	return NewOpaqueColor(int(n.R), int(n.G), int(n.B))
+}
+
+// MarshalJSON encodes the color as A PaletteEntry.
+func (ic IndexedColorRGBA) MarshalJSON() ([]byte, error) {
+	return json.Marshal(PaletteEntry{Id: ic.Id, Name: ic.Name, Color: hexColor(ic.ColorRGBA)})
+}
+
+// UnmarshalJSON decodes A PaletteEntry into the color, leaving out its metadata.
+func (ic *IndexedColorRGBA) UnmarshalJSON(data []byte) error {
+	var e PaletteEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	c, err := parseHexColor(e.Color)
+	if err != nil {
+		return err
+	}
+	ic.ColorRGBA, ic.Id, ic.Name = c, e.Id, e.Name
+	return nil
+}
+
+// metricName returns the name of the built-in metrics in the JSON schema, or an empty string for the others.
+func metricName(m Metric) string {
+	switch m.(type) {
+	case euclideanRGB:
+		return "euclidean-rgb"
+	case cie76:
+		return "cie76"
+	case cie94:
+		return "cie94"
+	case ciede2000:
+		return "ciede2000"
+	case oklab:
+		return "oklab"
+	}
+	return ""
+}
+
+// metricByName returns the built-in metric with the given name in the JSON schema, defaulting to EuclideanRGB.
+func metricByName(name string) (Metric, error) {
+	for _, m := range []Metric{EuclideanRGB, CIE76, CIE94, CIEDE2000, Oklab} {
+		if metricName(m) == name {
+			return m, nil
+		}
+	}
+	if name == "" {
+		return EuclideanRGB, nil
+	}
+	return nil, fmt.Errorf("unknown metric %q", name)
+}
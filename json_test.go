@@ -0,0 +1,161 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+
+package treepalette_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/philoj/tree-palette"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+const paletteJSON = `{
+  "version": 1,
+  "name": "Brand",
+  "alpha": true,
+  "metric": "oklab",
+  "metadata": {"owner": "design"},
+  "colors": [
+    {"id": 3, "name": "Red", "color": "#FF0000", "metadata": {"pantone": "485 C"}},
+    {"id": 1, "color": "#0080FF80"}
+  ]
+}`
+
+func TestLoadJSON(t *testing.T) {
+	p, err := treepalette.LoadJSON(strings.NewReader(paletteJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, p.Indexes())
+	assert.Equal(t, treepalette.IndexedColorRGBA{
+		ColorRGBA: treepalette.ColorRGBA{R: 0xffff, A: 0xffff, AlphaChannel: true},
+		Id:        3,
+		Name:      "Red",
+	}, p.ConvertColor(treepalette.NewTransparentColor(250, 0, 0, 1)))
+	assert.Equal(t, treepalette.IndexedColorRGBA{
+		ColorRGBA: treepalette.ColorRGBA{G: 0x4080, B: 0x8080, A: 0x8080, AlphaChannel: true},
+		Id:        1,
+	}, p.ConvertColor(treepalette.ColorRGBA{G: 0x4040, B: 0x8080, A: 0x8080, AlphaChannel: true}))
+
+	data, err := json.Marshal(p)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "alpha": true, "metric": "oklab", "colors": [
+		{"id": 1, "color": "#0080FF80"},
+		{"id": 3, "name": "Red", "color": "#FF0000FF"}
+	]}`, string(data))
+
+	// round trip
+	again, err := treepalette.LoadJSON(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, p.Indexes(), again.Indexes())
+	assert.Equal(t, treepalette.NewPaletteFile(p, "Brand"), treepalette.NewPaletteFile(again, "Brand"))
+
+	// without alpha, colors are opaque
+	p, err = treepalette.LoadJSON(strings.NewReader(`{"colors": [{"id": 0, "color": "0080FF80"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, treepalette.NewOpaquePaletteColor(0, 128, 255, 0, ""), p.ConvertColor(treepalette.NewOpaqueColor(0, 0, 0)))
+
+	for _, invalid := range []string{
+		`{"version": 2, "colors": []}`,
+		`{"metric": "cmyk", "colors": []}`,
+		`{"colors": [{"id": 0, "color": "#FF00"}]}`,
+		`{"colors": [{"id": 0}]}`,
+		`{"colors": [{"id": 0, "color": "#FF0000"}, {"id": 0, "color": "#00FF00"}]}`,
+		`{"colors": [{"id": -1, "color": "#FF0000"}]}`,
+		`{"colours": []}`,
+	} {
+		_, err := treepalette.LoadJSON(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	p, err := treepalette.LoadJSON(strings.NewReader(paletteJSON))
+	assert.NoError(t, err)
+	data, err := yaml.Marshal(p)
+	assert.NoError(t, err)
+	loaded, err := treepalette.LoadYAML(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, p.Indexes(), loaded.Indexes())
+	assert.Equal(t, treepalette.NewPaletteFile(p, "Brand"), treepalette.NewPaletteFile(loaded, "Brand"))
+
+	// the file keeps the name and metadata
+	var f treepalette.PaletteFile
+	assert.NoError(t, json.Unmarshal([]byte(paletteJSON), &f))
+	data, err = yaml.Marshal(f)
+	assert.NoError(t, err)
+	var decoded treepalette.PaletteFile
+	assert.NoError(t, yaml.Unmarshal(data, &decoded))
+	assert.Equal(t, f, decoded)
+
+	p, err = treepalette.LoadYAML(strings.NewReader("alpha: true\ncolors:\n  - {id: 2, name: Red, color: \"#FF0000\"}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Red", p.ConvertColor(treepalette.NewTransparentColor(250, 0, 0, 1)).(treepalette.IndexedColorRGBA).Name)
+	for _, invalid := range []string{"colours: []\n", "colors:\n  - {id: 0, color: red}\n", "version: 2\ncolors: []\n"} {
+		_, err := treepalette.LoadYAML(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLoadJSON_MixedAlpha(t *testing.T) {
+	rand.Seed(31)
+	f := treepalette.PaletteFile{Alpha: true}
+	for i := 0; i < 200; i++ {
+		hex := fmt.Sprintf("#%06X", rand.Intn(1<<24))
+		if i%2 == 0 {
+			hex += fmt.Sprintf("%02X", rand.Intn(256))
+		}
+		f.Colors = append(f.Colors, treepalette.PaletteEntry{Id: i, Color: hex})
+	}
+	data, err := json.Marshal(f)
+	assert.NoError(t, err)
+	p, err := treepalette.LoadJSON(bytes.NewReader(data))
+	assert.NoError(t, err)
+	for i := 0; i < 2000; i++ {
+		q := treepalette.NewTransparentColor(rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Float64())
+		all := p.WithinDistance(q, math.Inf(1))
+		assert.Len(t, all, 200)
+		assert.Equal(t, all[0].Distance, p.ConvertColorWithDistance(q).Distance)
+	}
+}
+
+func TestIndexedColorRGBA_JSON(t *testing.T) {
+	c := treepalette.NewOpaquePaletteColor(16, 32, 48, 7, "Navy")
+	data, err := json.Marshal(c)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": 7, "name": "Navy", "color": "#102030"}`, string(data))
+	var decoded treepalette.IndexedColorRGBA
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, c, decoded)
+
+	translucent := treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0x8080, A: 0x8080, AlphaChannel: true}}
+	data, err = json.Marshal(translucent)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": 0, "color": "#FF000080"}`, string(data))
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, translucent, decoded)
+	assert.Error(t, json.Unmarshal([]byte(`{"id": 0, "color": "red"}`), &decoded))
+
+	// plain colors keep their 16-bit channels
+	data, err = json.Marshal(translucent.ColorRGBA)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"R": 32896, "G": 0, "B": 0, "A": 32896, "AlphaChannel": true}`, string(data))
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"image"
+	"math/rand"
+)
+
+// defaultIterations the default limit of KMeans iterations.
+const defaultIterations = 20
+
+// KMeans generates A palette by k-means clustering of the pixel colors, seeded with k-means++.
+// Every iteration assigns the pixels to their closest centers by A kd-tree search in A Palette of the centers,
+// then moves each center to the mean of its pixels.
+// See: https://en.wikipedia.org/wiki/K-means%2B%2B
+type KMeans struct {
+	Metric        Metric  // Metric is the color space the clusters are formed in. Defaults to EuclideanRGB.
+	Alpha         bool    // Alpha if true, generates transparent colors clustering on alpha too, otherwise opaque colors.
+	MaxIterations int     // MaxIterations limits the number of iterations. Defaults to 20.
+	Tolerance     float64 // Tolerance stops the iterations once no center moves further than this, measured by Metric.
+	Seed          int64   // Seed of the random choices, the same seed generating the same colors.
+	MaxSamples    int     // MaxSamples if positive, clusters only this many pixels picked at random.
+}
+
+// Quantize generates at most n colors from the pixels of the images, ready for NewPalette with the same alpha and Metric.
+// Colors are ordered by the number of pixels they stand for, most first, and indexed from 0 in that order.
+// Without alpha, fully transparent pixels are left out.
+func (k KMeans) Quantize(n int, images ...image.Image) []PaletteColor {
+	rng := rand.New(rand.NewSource(k.Seed))
+	var bins []bin
+	if k.MaxSamples > 0 {
+		bins = sampleHistogram(images, k.Alpha, k.MaxSamples, rng)
+	} else {
+		bins = histogram(images, k.Alpha)
+	}
+	if n < 1 || len(bins) == 0 {
+		return nil
+	}
+	m := k.Metric
+	if m == nil {
+		m = EuclideanRGB
+	}
+	iterations := k.MaxIterations
+	if iterations <= 0 {
+		iterations = defaultIterations
+	}
+
+	c := newClustering(bins, m, k.Alpha)
+	if len(bins) <= n {
+		// every color makes A cluster of its own
+		for i := range bins {
+			c.centers = append(c.centers, c.values[i])
+			c.assigned[i] = i
+		}
+	} else {
+		c.seed(n, rng)
+		c.run(iterations, k.Tolerance)
+	}
+	return c.colors()
+}
+
+// clustering the state of A k-means clustering of histogram bins.
+type clustering struct {
+	bins     []bin
+	metric   Metric
+	alpha    bool
+	space    colorSpace
+	values   [][4]float64      // values coordinates of the mean color of each bin in space
+	queries  []ColorRGBA       // queries mean color of each bin
+	centers  [][4]float64      // centers coordinates of the centers in space
+	pinned   map[int]ColorRGBA // pinned colors of the centers which never move
+	assigned []int             // assigned center of each bin
+}
+
+func newClustering(bins []bin, m Metric, alpha bool) *clustering {
+	c := &clustering{
+		bins:     bins,
+		metric:   m,
+		alpha:    alpha,
+		space:    spaceOf(m),
+		values:   make([][4]float64, len(bins)),
+		queries:  make([]ColorRGBA, len(bins)),
+		assigned: make([]int, len(bins)),
+	}
+	for i, b := range bins {
+		c.values[i] = c.space.project(b.mean())
+		c.queries[i] = c.color(b.mean())
+	}
+	return c
+}
+
+// color converts RGBA values into A query color of the clustering.
+func (c *clustering) color(rgba [4]float64) ColorRGBA {
+	return ColorRGBA{
+		R:            uint32(clamp(rgba[0]) + 0.5),
+		G:            uint32(clamp(rgba[1]) + 0.5),
+		B:            uint32(clamp(rgba[2]) + 0.5),
+		A:            uint32(clamp(rgba[3]) + 0.5),
+		AlphaChannel: c.alpha,
+	}
+}
+
+// seed picks n centers among the bins by k-means++, each one with A probability proportional to the pixel count
+// and the squared distance to the closest center picked before.
+func (c *clustering) seed(n int, rng *rand.Rand) {
+	points := make([]Point, len(c.bins))
+	weights := make([]float64, len(c.bins))
+	for i, b := range c.bins {
+		points[i] = c.metric.Project(c.queries[i])
+		weights[i] = float64(b.count)
+	}
+	shortest := make([]float64, len(c.bins))
+	for len(c.centers) < n {
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+		if total == 0 {
+			break // the remaining bins coincide with the centers
+		}
+		pick, r := len(weights)-1, rng.Float64()*total
+		for i, w := range weights {
+			if r < w {
+				pick = i
+				break
+			}
+			r -= w
+		}
+		c.centers = append(c.centers, c.values[pick])
+		for i, p := range points {
+			d := c.metric.Distance(p, points[pick])
+			if len(c.centers) == 1 || d*d < shortest[i] {
+				shortest[i] = d * d
+			}
+			weights[i] = float64(c.bins[i].count) * shortest[i]
+		}
+	}
+}
+
+// run alternates between assigning the bins and updating the centers, until the centers move no further
+// than the tolerance or the iterations run out. The bins are left assigned to the final centers.
+func (c *clustering) run(iterations int, tolerance float64) {
+	for i := 0; i < iterations; i++ {
+		c.assign()
+		if c.update() <= tolerance {
+			break
+		}
+	}
+	c.assign()
+}
+
+// assign assigns each bin to its closest center.
+func (c *clustering) assign() {
+	colors := make([]PaletteColor, len(c.centers))
+	for i, v := range c.centers {
+		if pinned, ok := c.pinned[i]; ok {
+			colors[i] = IndexedColorRGBA{ColorRGBA: pinned, Id: i}
+		} else {
+			colors[i] = IndexedColorRGBA{ColorRGBA: c.color(c.space.unproject(v)), Id: i}
+		}
+	}
+	p := NewPalette(colors, c.alpha, WithMetric(c.metric))
+	for i, q := range c.queries {
+		c.assigned[i] = p.ConvertColor(q).Index()
+	}
+}
+
+// update moves the centers to the mean of their bins. Returns the longest move, measured by the metric.
+// Pinned centers and centers left without any bins stay in place.
+func (c *clustering) update() float64 {
+	sums := make([][4]float64, len(c.centers))
+	counts := make([]float64, len(c.centers))
+	for i, b := range c.bins {
+		v, w := c.values[i], float64(b.count)
+		for d := range v {
+			sums[c.assigned[i]][d] += v[d] * w
+		}
+		counts[c.assigned[i]] += w
+	}
+	var longest float64
+	for i := range c.centers {
+		if _, ok := c.pinned[i]; ok || counts[i] == 0 {
+			continue
+		}
+		var v [4]float64
+		for d := range v {
+			v[d] = sums[i][d] / counts[i]
+		}
+		moved := c.metric.Distance(
+			c.metric.Project(c.color(c.space.unproject(c.centers[i]))),
+			c.metric.Project(c.color(c.space.unproject(v))),
+		)
+		if moved > longest {
+			longest = moved
+		}
+		c.centers[i] = v
+	}
+	return longest
+}
+
+// colors creates the palette colors of the centers with any bins, ordered by their pixel counts.
+func (c *clustering) colors() []PaletteColor {
+	counts := make([]int, len(c.centers))
+	for i, b := range c.bins {
+		counts[c.assigned[i]] += b.count
+	}
+	var used []int
+	var values [][4]float64
+	for i, center := range c.centers {
+		if counts[i] > 0 {
+			used = append(used, counts[i])
+			values = append(values, c.space.unproject(center))
+		}
+	}
+	return byCount(used, values, c.alpha)
+}
+
+// colorSpace the coordinates in which the mean colors are computed for A Metric.
+// The alpha channel is carried over as is.
+type colorSpace struct {
+	project   func(rgba [4]float64) [4]float64
+	unproject func(v [4]float64) [4]float64
+}
+
+// spaceOf returns the color space of the built-in metrics, defaulting to the 16-bit RGBA space for the others.
+func spaceOf(m Metric) colorSpace {
+	var to func(r, g, b uint32) (float64, float64, float64)
+	var from func(x, y, z float64) (uint32, uint32, uint32)
+	switch m.(type) {
+	case cie76, cie94, ciede2000:
+		to, from = rgbToLab, labToRGB
+	case oklab:
+		to, from = rgbToOklab, oklabToRGB
+	default:
+		identity := func(v [4]float64) [4]float64 { return v }
+		return colorSpace{project: identity, unproject: identity}
+	}
+	return colorSpace{
+		project: func(rgba [4]float64) [4]float64 {
+			var v [4]float64
+			v[0], v[1], v[2] = to(uint32(clamp(rgba[0])+0.5), uint32(clamp(rgba[1])+0.5), uint32(clamp(rgba[2])+0.5))
+			v[3] = rgba[3]
+			return v
+		},
+		unproject: func(v [4]float64) [4]float64 {
+			r, g, b := from(v[0], v[1], v[2])
+			return [4]float64{float64(r), float64(g), float64(b), v[3]}
+		},
+	}
+}
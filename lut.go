@@ -0,0 +1,280 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	lutMagic   = "TPLT"
+	lutVersion = 1
+
+	// lutRefine marks the cells of A LUT which are too close to the boundary between palette colors,
+	// whose colors are searched in the kd-tree instead.
+	lutRefine = math.MinInt32
+)
+
+// LUT is A dense lookup table mapping every quantized RGB color to the index of its closest palette color.
+// Cells of the table which are split between several palette colors fall back to the exact kd-tree search,
+// so A palette converts the same colors with or without A LUT.
+//
+// Deciding which cells are split is exact for EuclideanRGB, where the cells are boxes in the space of the metric.
+// Other metrics distort the cells, which are then judged by their corners, so use enough bits with them.
+type LUT struct {
+	bits        int     // bits is the number of bits per channel
+	fingerprint uint32  // fingerprint of the palette the table was baked for
+	cells       []int32 // cells palette index of each cell, Unmatched or lutRefine
+}
+
+// NewLUT bakes A lookup table for the given opaque palette with the given bits per channel in range [1-8].
+// The table takes 4 * 2^(3*bits) bytes of memory, 64 MiB with 8 bits. See Palette.UseLUT.
+// Custom metrics aren't supported, as A table baked for one can't be told apart from one baked for another
+// instance of the same type with different parameters.
+func NewLUT(t *Palette, bits int) (*LUT, error) {
+	if bits < 1 || bits > 8 {
+		return nil, fmt.Errorf("invalid bits %d: expected [1-8]", bits)
+	}
+	if t.alpha {
+		return nil, errors.New("lookup tables support only opaque palettes")
+	}
+	if metricName(t.metric) == "" {
+		return nil, fmt.Errorf("lookup tables support only the built-in metrics, not %T", t.metric)
+	}
+	if t.root == nil {
+		return nil, errors.New("empty palette")
+	}
+	for index := range t.lookup {
+		if index <= lutRefine || index > math.MaxInt32 {
+			return nil, fmt.Errorf("index %d out of range for A lookup table", index)
+		}
+	}
+
+	l := &LUT{
+		bits:        bits,
+		fingerprint: t.fingerprint(),
+		cells:       make([]int32, 1<<(3*bits)),
+	}
+	n := 1 << bits
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rows {
+				l.bake(t, r)
+			}
+		}()
+	}
+	for r := 0; r < n; r++ {
+		rows <- r
+	}
+	close(rows)
+	wg.Wait()
+	return l, nil
+}
+
+// bake fills in the cells with the given red value.
+func (l *LUT) bake(t *Palette, r int) {
+	n, shift := 1<<l.bits, uint(16-l.bits)
+	edge := func(i int) uint32 {
+		if i == n {
+			return 0xffff
+		}
+		return uint32(i) << shift
+	}
+	center := func(i int) uint32 {
+		return uint32(i)<<shift + (1<<shift-1)/2
+	}
+
+	// projected corners of the cells on both sides of this red slab, shared between neighbouring cells
+	var corners [2][]Point
+	for side := range corners {
+		corners[side] = make([]Point, (n+1)*(n+1))
+		for g := 0; g <= n; g++ {
+			for b := 0; b <= n; b++ {
+				corners[side][g*(n+1)+b] = t.metric.Project(ColorRGBA{R: edge(r + side), G: edge(g), B: edge(b)})
+			}
+		}
+	}
+
+	h := make(matchHeap, 0, 3)
+	var cell [8]Point
+	for g := 0; g < n; g++ {
+		for b := 0; b < n; b++ {
+			q := t.metric.Project(ColorRGBA{R: center(r), G: center(g), B: center(b)})
+			var radius float64
+			for side := range corners {
+				for i, c := range []int{g*(n+1) + b, g*(n+1) + b + 1, (g+1)*(n+1) + b, (g+1)*(n+1) + b + 1} {
+					cell[side*4+i] = corners[side][c]
+					radius = math.Max(radius, t.metric.Distance(q, corners[side][c]))
+				}
+			}
+
+			h = h[:0]
+			knn(t.metric, q, t.root, 0, 2, &h)
+			sortMatches(h)
+			index := int32(lutRefine)
+			if h[0].Distance-radius >= t.limit {
+				index = Unmatched
+			} else if l.owns(t, q, radius, cell, h) {
+				index = int32(h[0].Color.Index())
+			}
+			l.cells[(r<<l.bits|g)<<l.bits|b] = index
+		}
+	}
+}
+
+// owns checks whether the closest color h[0] to the center q of A cell is the closest color to every point in the cell,
+// given the 2 closest colors h to the center, the corners of the cell and its radius.
+func (l *LUT) owns(t *Palette, q Point, radius float64, corners [8]Point, h matchHeap) bool {
+	nearest := t.metric.Project(h[0].Color)
+	for _, c := range corners {
+		if t.metric.Distance(c, nearest) >= t.limit {
+			return false
+		}
+	}
+	if len(h) == 1 || h[0].Distance+radius < h[1].Distance-radius {
+		return true
+	}
+
+	// Only the colors within this distance may be closer than the nearest one somewhere in the cell.
+	// Points closer to one color than to another form A half-space, so checking the corners covers the whole cell.
+	var candidates []Match
+	rangeSearch(t.metric, q, t.root, 0, h[0].Distance+2*radius, &candidates)
+	for _, m := range candidates {
+		if m.Color.Index() == h[0].Color.Index() {
+			continue
+		}
+		p := t.metric.Project(m.Color)
+		for _, c := range corners {
+			if t.metric.Distance(c, nearest) >= t.metric.Distance(c, p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Bits returns the number of bits per channel of the table.
+func (l *LUT) Bits() int {
+	return l.bits
+}
+
+// convert looks up the palette index of the given color.
+// Returns false if the color can't be looked up, or it needs an exact search.
+func (l *LUT) convert(p Color) (int, bool) {
+	c, ok := p.(ColorRGBA)
+	if !ok {
+		return 0, false
+	}
+	return l.convertRGBA(c)
+}
+
+// convertRGBA is convert of A ColorRGBA.
+func (l *LUT) convertRGBA(c ColorRGBA) (int, bool) {
+	if c.AlphaChannel || c.R > 0xffff || c.G > 0xffff || c.B > 0xffff {
+		return 0, false
+	}
+	shift := uint(16 - l.bits)
+	cell := l.cells[(int(c.R>>shift)<<l.bits|int(c.G>>shift))<<l.bits|int(c.B>>shift)]
+	if cell == lutRefine {
+		return 0, false
+	}
+	return int(cell), true
+}
+
+// UseLUT makes the palette convert colors through the given lookup table, which must have been baked for
+// an identical palette. Passing nil stops using the table. Mutating the palette also drops the table.
+func (t *Palette) UseLUT(l *LUT) error {
+	if l != nil && metricName(t.metric) == "" {
+		return fmt.Errorf("lookup tables support only the built-in metrics, not %T", t.metric)
+	}
+	if l != nil && l.fingerprint != t.fingerprint() {
+		return errors.New("lookup table was baked for A different palette")
+	}
+	t.lut = l
+	return nil
+}
+
+// fingerprint identifies the colors and the settings of the palette which decide the closest colors.
+func (t *Palette) fingerprint() uint32 {
+	h := crc32.NewIEEE()
+	_, _ = fmt.Fprintf(h, "%s %v %v", metricName(t.metric), t.alpha, t.limit)
+	for _, index := range t.Indexes() {
+		c := t.lookup[index]
+		_, _ = fmt.Fprintf(h, " %d", index)
+		for d := 0; d < c.Dimensions(); d++ {
+			_, _ = fmt.Fprintf(h, ":%d", c.Dimension(d))
+		}
+	}
+	return h.Sum32()
+}
+
+// MarshalBinary encodes the table as A header with the format version, followed by the cells and A CRC-32 checksum.
+func (l *LUT) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 14+4*len(l.cells)+4)
+	data = append(data, lutMagic...)
+	data = append(data, lutVersion, byte(l.bits))
+	data = appendUint32(data, l.fingerprint)
+	data = appendUint32(data, uint32(len(l.cells)))
+	for _, cell := range l.cells {
+		data = appendUint32(data, uint32(cell))
+	}
+	return appendUint32(data, crc32.ChecksumIEEE(data)), nil
+}
+
+// UnmarshalBinary decodes A table encoded by MarshalBinary.
+func (l *LUT) UnmarshalBinary(data []byte) error {
+	if len(data) < 18 || string(data[:4]) != lutMagic {
+		return errors.New("not A lookup table")
+	}
+	if data[4] != lutVersion {
+		return fmt.Errorf("unsupported lookup table version %d", data[4])
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return errors.New("lookup table checksum mismatch")
+	}
+	bits := int(data[5])
+	if bits < 1 || bits > 8 {
+		return fmt.Errorf("invalid bits %d: expected [1-8]", bits)
+	}
+	count := binary.LittleEndian.Uint32(data[10:14])
+	if count != 1<<(3*bits) || len(body) != 14+4*int(count) {
+		return errors.New("lookup table size mismatch")
+	}
+	l.bits = bits
+	l.fingerprint = binary.LittleEndian.Uint32(data[6:10])
+	l.cells = make([]int32, count)
+	for i := range l.cells {
+		l.cells[i] = int32(binary.LittleEndian.Uint32(body[14+4*i:]))
+	}
+	return nil
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(data, b[:]...)
+}
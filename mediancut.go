@@ -0,0 +1,132 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"image"
+	"sort"
+)
+
+// MedianCut generates A palette by repeatedly splitting the box of pixel colors with the widest range
+// at the median of that channel, until there are enough boxes. Each box makes one color, the mean of its pixels.
+// See: https://en.wikipedia.org/wiki/Median_cut
+type MedianCut struct {
+	Alpha bool // Alpha if true, generates transparent colors splitting on alpha too, otherwise opaque colors.
+}
+
+// Quantize generates at most n colors from the pixels of the images, ready for NewPalette with the same alpha.
+// Colors are ordered by the number of pixels they stand for, most first, and indexed from 0 in that order.
+// Without alpha, fully transparent pixels are left out.
+func (m MedianCut) Quantize(n int, images ...image.Image) []PaletteColor {
+	bins := histogram(images, m.Alpha)
+	if n < 1 || len(bins) == 0 {
+		return nil
+	}
+	dims := 3
+	if m.Alpha {
+		dims = 4
+	}
+
+	boxes := []*cutBox{newCutBox(bins, dims)}
+	for len(boxes) < n {
+		widest := -1
+		for i, b := range boxes {
+			if len(b.bins) > 1 && (widest < 0 || b.width() > boxes[widest].width()) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break // every box is down to A single color
+		}
+		left, right := boxes[widest].split()
+		boxes[widest] = left
+		boxes = append(boxes, right)
+	}
+
+	counts, values := make([]int, len(boxes)), make([][4]float64, len(boxes))
+	for i, b := range boxes {
+		counts[i], values[i] = b.count, b.mean()
+	}
+	return byCount(counts, values, m.Alpha)
+}
+
+// cutBox A box of the median cut, holding the histogram bins within.
+type cutBox struct {
+	bins     []bin
+	dims     int
+	count    int        // count of pixels
+	min, max [4]float64 // min and max values of the bins in each channel
+}
+
+func newCutBox(bins []bin, dims int) *cutBox {
+	b := &cutBox{bins: bins, dims: dims}
+	for i, h := range bins {
+		v := h.mean()
+		for d := 0; d < dims; d++ {
+			if i == 0 || v[d] < b.min[d] {
+				b.min[d] = v[d]
+			}
+			if i == 0 || v[d] > b.max[d] {
+				b.max[d] = v[d]
+			}
+		}
+		b.count += h.count
+	}
+	return b
+}
+
+// axis returns the channel with the widest range.
+func (b *cutBox) axis() int {
+	axis := 0
+	for d := 1; d < b.dims; d++ {
+		if b.max[d]-b.min[d] > b.max[axis]-b.min[axis] {
+			axis = d
+		}
+	}
+	return axis
+}
+
+// width returns the range of the widest channel.
+func (b *cutBox) width() float64 {
+	axis := b.axis()
+	return b.max[axis] - b.min[axis]
+}
+
+// split splits the box at the median pixel of its widest channel. The box must have at least 2 bins.
+func (b *cutBox) split() (*cutBox, *cutBox) {
+	axis := b.axis()
+	sort.SliceStable(b.bins, func(i, j int) bool {
+		return b.bins[i].mean()[axis] < b.bins[j].mean()[axis]
+	})
+	cut, seen := 1, b.bins[0].count
+	for cut < len(b.bins)-1 && seen+b.bins[cut].count <= b.count/2 {
+		seen += b.bins[cut].count
+		cut++
+	}
+	return newCutBox(b.bins[:cut], b.dims), newCutBox(b.bins[cut:], b.dims)
+}
+
+// mean returns the mean RGBA values of the pixels in the box.
+func (b *cutBox) mean() [4]float64 {
+	var sum [4]float64
+	for _, h := range b.bins {
+		for d := range sum {
+			sum[d] += h.sum[d]
+		}
+	}
+	n := float64(b.count)
+	return [4]float64{sum[0] / n, sum[1] / n, sum[2] / n, sum[3] / n}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"fmt"
+	"math"
+)
+
+// Point is a color projected into the coordinate space of a Metric.
+// The kd-tree of a Palette is built on these coordinates rather than on the raw Color dimensions.
+type Point struct {
+	X [4]float64 // X holds the coordinates, only the first N are meaningful.
+	N int        // N is the number of coordinates, 3 without alpha and 4 with alpha.
+}
+
+// Metric measures the distance between colors during Palette lookups.
+//
+// The kd-tree is built on the coordinates returned by Project and PlaneDistance is used to skip
+// the branches of the tree which cannot contain a closer color. So PlaneDistance must never
+// be larger than the actual Distance, otherwise the search may miss the closest color.
+type Metric interface {
+
+	// Project maps the color onto the coordinate space of the metric.
+	Project(c Color) Point
+
+	// Distance returns the distance from the query q to the palette color p.
+	Distance(q, p Point) float64
+
+	// PlaneDistance returns a lower bound of Distance(q, p) for every p whose axis-th
+	// coordinate lies on the other side of the given plane position.
+	PlaneDistance(q Point, plane float64, axis int) float64
+}
+
+var (
+	// EuclideanRGB is the straight-line distance in the 16-bit RGBA space. This is the default Metric.
+	EuclideanRGB Metric = euclideanRGB{}
+
+	// CIE76 is the straight-line distance(ΔE*ab) in the CIE L*a*b* space.
+	CIE76 Metric = cie76{}
+
+	// CIE94 is the ΔE*94 color difference with the graphic arts weights, taking the query as the reference color.
+	CIE94 Metric = cie94{}
+
+	// CIEDE2000 is the ΔE00 color difference.
+	// Its pruning bounds are loose, so lookups visit more of the tree than with the other metrics.
+	CIEDE2000 Metric = ciede2000{}
+)
+
+// rgbaProjector is implemented by the built-in metrics, projecting ColorRGBA queries without boxing them into A Color.
+type rgbaProjector interface {
+	projectRGBA(c ColorRGBA) Point
+}
+
+// euclideanRGB is the Metric behind EuclideanRGB.
+type euclideanRGB struct{}
+
+func (euclideanRGB) Project(c Color) Point {
+	p := Point{N: c.Dimensions()}
+	if p.N > len(p.X) {
+		panic(fmt.Errorf("invalid dimensions %d: expected at most %d", p.N, len(p.X)))
+	}
+	i := 0
+	if p.N >= 3 {
+		r, g, b := rgbDimensions(c)
+		p.X[0], p.X[1], p.X[2], i = float64(r), float64(g), float64(b), 3
+	}
+	for ; i < p.N; i++ {
+		p.X[i] = float64(c.Dimension(i))
+	}
+	return p
+}
+
+func (euclideanRGB) projectRGBA(c ColorRGBA) Point {
+	p := Point{X: [4]float64{float64(c.R), float64(c.G), float64(c.B)}, N: 3}
+	if c.AlphaChannel {
+		p.X[3], p.N = float64(c.A), 4
+	}
+	return p
+}
+
+func (euclideanRGB) Distance(q, p Point) float64 {
+	return euclidean(q, p)
+}
+
+func (euclideanRGB) PlaneDistance(q Point, plane float64, axis int) float64 {
+	return math.Abs(q.X[axis] - plane)
+}
+
+// cie76 is the Metric behind CIE76.
+type cie76 struct{}
+
+func (cie76) Project(c Color) Point {
+	return labPoint(c)
+}
+
+func (cie76) projectRGBA(c ColorRGBA) Point {
+	return labPointRGBA(c)
+}
+
+func (cie76) Distance(q, p Point) float64 {
+	return euclidean(q, p)
+}
+
+func (cie76) PlaneDistance(q Point, plane float64, axis int) float64 {
+	return math.Abs(q.X[axis] - plane)
+}
+
+// cie94 is the Metric behind CIE94.
+type cie94 struct{}
+
+func (cie94) Project(c Color) Point {
+	return labPoint(c)
+}
+
+func (cie94) projectRGBA(c ColorRGBA) Point {
+	return labPointRGBA(c)
+}
+
+func (cie94) Distance(q, p Point) float64 {
+	dL := q.X[0] - p.X[0]
+	da, db := q.X[1]-p.X[1], q.X[2]-p.X[2]
+	c1 := math.Hypot(q.X[1], q.X[2])
+	dC := c1 - math.Hypot(p.X[1], p.X[2])
+	dH2 := math.Max(da*da+db*db-dC*dC, 0)
+	sC, sH := 1+0.045*c1, 1+0.015*c1
+	d := dL*dL + (dC*dC)/(sC*sC) + dH2/(sH*sH)
+	return math.Sqrt(d + alphaDiff2(q, p))
+}
+
+func (cie94) PlaneDistance(q Point, plane float64, axis int) float64 {
+	d := math.Abs(q.X[axis] - plane)
+	if axis == 1 || axis == 2 {
+		// SC >= SH, so ΔC²/SC² + ΔH²/SH² >= (Δa² + Δb²)/SC²
+		return d / (1 + 0.045*math.Hypot(q.X[1], q.X[2]))
+	}
+	return d
+}
+
+// ciede2000 is the Metric behind CIEDE2000.
+type ciede2000 struct{}
+
+// Bounds of the CIEDE2000 weighting terms used for pruning.
+const (
+	// maxChroma is an upper bound of the L*a*b* chroma of sRGB colors.
+	maxChroma = 135.0
+
+	// maxSL is the largest possible value of the lightness weight SL.
+	maxSL = 1.7471
+
+	// minRotation is the smallest possible value of 1-|RT|/2, since |RT| <= 2*sin(60°).
+	minRotation = 1 - 0.8661
+)
+
+func (ciede2000) Project(c Color) Point {
+	return labPoint(c)
+}
+
+func (ciede2000) projectRGBA(c ColorRGBA) Point {
+	return labPointRGBA(c)
+}
+
+func (ciede2000) Distance(q, p Point) float64 {
+	l1, a1, b1 := q.X[0], q.X[1], q.X[2]
+	l2, a2, b2 := p.X[0], p.X[1], p.X[2]
+
+	cBar := (math.Hypot(a1, b1) + math.Hypot(a2, b2)) / 2
+	cBar7 := math.Pow(cBar, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+6103515625))) // 25^7
+	a1, a2 = a1*(1+g), a2*(1+g)
+	c1, c2 := math.Hypot(a1, b1), math.Hypot(a2, b2)
+	h1, h2 := hueAngle(a1, b1), hueAngle(a2, b2)
+
+	dL := l2 - l1
+	dC := c2 - c1
+	var dh float64
+	if c1*c2 != 0 {
+		dh = h2 - h1
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(radians(dh/2))
+
+	lBar := (l1 + l2) / 2
+	cBar = (c1 + c2) / 2
+	hBar := h1 + h2
+	if c1*c2 != 0 {
+		if math.Abs(h1-h2) > 180 {
+			if hBar < 360 {
+				hBar += 360
+			} else {
+				hBar -= 360
+			}
+		}
+		hBar /= 2
+	}
+	t := 1 - 0.17*math.Cos(radians(hBar-30)) +
+		0.24*math.Cos(radians(2*hBar)) +
+		0.32*math.Cos(radians(3*hBar+6)) -
+		0.20*math.Cos(radians(4*hBar-63))
+	dTheta := 30 * math.Exp(-math.Pow((hBar-275)/25, 2))
+	cBar7 = math.Pow(cBar, 7)
+	rC := 2 * math.Sqrt(cBar7/(cBar7+6103515625))
+	lBar50 := (lBar - 50) * (lBar - 50)
+	sL := 1 + 0.015*lBar50/math.Sqrt(20+lBar50)
+	sC := 1 + 0.045*cBar
+	sH := 1 + 0.015*cBar*t
+	rT := -math.Sin(radians(2*dTheta)) * rC
+
+	l, c, h := dL/sL, dC/sC, dH/sH
+	d := l*l + c*c + h*h + rT*c*h
+	return math.Sqrt(math.Max(d, 0) + alphaDiff2(q, p))
+}
+
+func (ciede2000) PlaneDistance(q Point, plane float64, axis int) float64 {
+	d := math.Abs(q.X[axis] - plane)
+	switch axis {
+	case 0:
+		return d / maxSL
+	case 1, 2:
+		// |Δa'| >= |Δa|, SH < SC and the rotation term takes away at most minRotation of the
+		// chroma-hue part, which leaves at least sqrt(minRotation)*sqrt(Δa'² + Δb²)/SC.
+		sC := 1 + 0.045*1.5*(math.Hypot(q.X[1], q.X[2])+maxChroma)/2
+		return d * math.Sqrt(minRotation) / sC
+	default:
+		return d
+	}
+}
+
+// labPoint projects the color into the L*a*b* space. Alpha, if present, is scaled into [0-100] like L*.
+func labPoint(c Color) Point {
+	p := Point{N: c.Dimensions()}
+	p.X[0], p.X[1], p.X[2] = rgbToLab(rgbDimensions(c))
+	if p.N > 3 {
+		p.X[3] = float64(clamp16(c.Dimension(3))) / 0xffff * 100
+	}
+	return p
+}
+
+// labPointRGBA is labPoint of A ColorRGBA.
+func labPointRGBA(c ColorRGBA) Point {
+	p := Point{N: 3}
+	p.X[0], p.X[1], p.X[2] = rgbToLab(c.R, c.G, c.B)
+	if c.AlphaChannel {
+		p.X[3], p.N = float64(clamp16(c.A))/0xffff*100, 4
+	}
+	return p
+}
+
+// rgbToLab converts 16-bit sRGB values into L*a*b* coordinates under the D65 white point.
+func rgbToLab(r, g, b uint32) (float64, float64, float64) {
+	lr, lg, lb := linearize(r), linearize(g), linearize(b)
+	x := (0.4124564*lr + 0.3575761*lg + 0.1804375*lb) / 0.95047
+	y := 0.2126729*lr + 0.7151522*lg + 0.0721750*lb
+	z := (0.0193339*lr + 0.1191920*lg + 0.9503041*lb) / 1.08883
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// labToRGB converts L*a*b* coordinates under the D65 white point into 16-bit sRGB values, clipping colors outside the gamut.
+func labToRGB(L, a, b float64) (uint32, uint32, uint32) {
+	fy := (L + 16) / 116
+	x := labFInverse(fy+a/500) * 0.95047
+	y := labFInverse(fy)
+	z := labFInverse(fy-b/200) * 1.08883
+	return delinearize(3.2404542*x - 1.5371385*y - 0.4985314*z),
+		delinearize(-0.9692660*x + 1.8760108*y + 0.0415560*z),
+		delinearize(0.0556434*x - 0.2040259*y + 1.0572252*z)
+}
+
+// linearize converts a 16-bit sRGB channel value into linear light in range [0-1].
+func linearize(v uint32) float64 {
+	c := float64(clamp16(v)) / 0xffff
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// delinearize converts linear light in range [0-1] into a 16-bit sRGB channel value.
+func delinearize(v float64) uint32 {
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint32(math.Round(math.Max(0, math.Min(1, v)) * 0xffff))
+}
+
+func labF(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func labFInverse(f float64) float64 {
+	if t := f * f * f; t > 216.0/24389 {
+		return t
+	}
+	return (116*f - 16) * 27 / 24389
+}
+
+func clamp16(v uint32) uint32 {
+	if v > 0xffff {
+		return 0xffff
+	}
+	return v
+}
+
+func euclidean(q, p Point) float64 {
+	var sum float64
+	for i := 0; i < q.N && i < p.N; i++ {
+		d := q.X[i] - p.X[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// alphaDiff2 returns the squared difference of the alpha coordinates, if both points have one.
+func alphaDiff2(q, p Point) float64 {
+	if q.N < 4 || p.N < 4 {
+		return 0
+	}
+	d := q.X[3] - p.X[3]
+	return d * d
+}
+
+// hueAngle returns the hue angle of a,b in degrees in range [0-360).
+func hueAngle(a, b float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
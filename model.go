@@ -22,13 +22,22 @@ import "image/color"
 //
 
 // Convert converts the given color into one of the palette colors.
+// Unmatched colors are converted into the fallback color. See WithThreshold.
 func (t *Palette) Convert(p color.Color) color.Color {
 	c := ColorRGBA{AlphaChannel: t.alpha}
 	c.R, c.G, c.B, c.A = p.RGBA()
 	c.AlphaChannel = t.alpha
 	res := t.ConvertColor(c)
+	if res == nil {
+		return t.fallback
+	}
+	return t.toColor(res)
+}
+
+// toColor converts A palette color into A color.Color, ignoring its alpha value unless the palette has alpha.
+func (t *Palette) toColor(res PaletteColor) color.Color {
 	cc := ColorRGBA{AlphaChannel: t.alpha}
-	cc.R, cc.G, cc.B = res.Dimension(0), res.Dimension(1), res.Dimension(2)
+	cc.R, cc.G, cc.B = rgbDimensions(res)
 	if t.alpha {
 		cc.A = res.Dimension(3)
 	} else {
@@ -39,7 +48,7 @@ func (t *Palette) Convert(p color.Color) color.Color {
 
 // Create Palette as color.Model from A list of color.Color
 // alpha if false, ignores transparency(A) values
-func NewPalettedColorModel(colors []color.Color, alpha bool) color.Model {
+func NewPalettedColorModel(colors []color.Color, alpha bool, opts ...Option) color.Model {
 	var nodes []PaletteColor
 	for i, p := range colors {
 		r, g, b, a := p.RGBA()
@@ -53,5 +62,5 @@ func NewPalettedColorModel(colors []color.Color, alpha bool) color.Model {
 				AlphaChannel: alpha},
 		})
 	}
-	return NewPalette(nodes, alpha)
+	return NewPalette(nodes, alpha, opts...)
 }
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// depthFactor the kd-tree is rebuilt once an insertion goes deeper than depthFactor times the depth of A balanced tree.
+const depthFactor = 2
+
+//
+// In place mutations of Palette. None of these are safe to run concurrently with lookups, see SyncPalette.
+//
+
+// Insert adds A new color into the palette. Fails if the palette already has A color with the same index.
+func (t *Palette) Insert(c PaletteColor) error {
+	if _, ok := t.lookup[c.Index()]; ok {
+		return fmt.Errorf("index %d already exists in the palette", c.Index())
+	}
+	t.lookup[c.Index()] = c
+	t.invalidate()
+	n := &node{PaletteColor: c, point: project(t.metric, c, t.alpha)}
+	if t.root == nil {
+		t.root = n
+		return nil
+	}
+
+	depth := 1
+	for current, axis := t.root, 0; ; axis = (axis + 1) % n.point.N {
+		depth++
+		if n.point.X[axis] < current.point.X[axis] {
+			if current.Left == nil {
+				current.Left = n
+				break
+			}
+			current = current.Left
+		} else {
+			if current.Right == nil {
+				current.Right = n
+				break
+			}
+			current = current.Right
+		}
+	}
+	if depth > depthFactor*bits.Len(uint(len(t.lookup))) {
+		t.rebalance()
+	}
+	return nil
+}
+
+// Remove deletes the color with the given index from the palette.
+func (t *Palette) Remove(index int) error {
+	c, ok := t.lookup[index]
+	if !ok {
+		return fmt.Errorf("index %d not found in the palette", index)
+	}
+	t.root, _ = remove(t.root, 0, project(t.metric, c, t.alpha), index)
+	delete(t.lookup, index)
+	t.invalidate()
+	return nil
+}
+
+// Update replaces the color with the given index. The new color must have the same index.
+func (t *Palette) Update(index int, c PaletteColor) error {
+	if c.Index() != index {
+		return fmt.Errorf("index mismatch: expected %d, got %d", index, c.Index())
+	}
+	if err := t.Remove(index); err != nil {
+		return err
+	}
+	return t.Insert(c)
+}
+
+// Clone returns A deep copy of the palette, which can be mutated without affecting the original.
+func (t *Palette) Clone() *Palette {
+	c := *t
+	if t.cache != nil {
+		c.cache = newLookupCache(t.cache.size)
+	}
+	c.root = cloneTree(t.root)
+	c.lookup = make(map[int]PaletteColor, len(t.lookup))
+	for i, p := range t.lookup {
+		c.lookup[i] = p
+	}
+	return &c
+}
+
+func cloneTree(n *node) *node {
+	if n == nil {
+		return nil
+	}
+	return &node{
+		PaletteColor: n.PaletteColor,
+		point:        n.point,
+		Left:         cloneTree(n.Left),
+		Right:        cloneTree(n.Right),
+	}
+}
+
+// invalidate drops the cached lookups and the lookup table, which are stale once the palette changes.
+func (t *Palette) invalidate() {
+	t.lut = nil
+	if t.cache != nil {
+		t.cache.reset()
+	}
+}
+
+// rebalance rebuilds the kd-tree from the current palette colors.
+func (t *Palette) rebalance() {
+	var nodes []node
+	collect(t.root, &nodes)
+	t.root = newColorTree(nodes, 0)
+}
+
+// collect appends copies of all the nodes in the subtree, leaving out their children.
+func collect(n *node, nodes *[]node) {
+	if n == nil {
+		return
+	}
+	collect(n.Left, nodes)
+	*nodes = append(*nodes, node{PaletteColor: n.PaletteColor, point: n.point})
+	collect(n.Right, nodes)
+}
+
+// remove deletes the node of the color with the given index and point from the subtree splitting on axis.
+// Returns the new root of the subtree and whether the node was found.
+func remove(n *node, axis int, p Point, index int) (*node, bool) {
+	if n == nil {
+		return nil, false
+	}
+	nextAxis := (axis + 1) % n.point.N
+	if n.Index() == index {
+		switch {
+		case n.Right != nil:
+			// replace with the closest node on the right side of the plane
+			m := findMin(n.Right, axis, nextAxis)
+			n.PaletteColor, n.point = m.PaletteColor, m.point
+			n.Right, _ = remove(n.Right, nextAxis, m.point, m.Index())
+		case n.Left != nil:
+			// replace with the closest node on the left side, which then becomes the right side
+			m := findMin(n.Left, axis, nextAxis)
+			n.PaletteColor, n.point = m.PaletteColor, m.point
+			n.Right, _ = remove(n.Left, nextAxis, m.point, m.Index())
+			n.Left = nil
+		default:
+			return nil, true
+		}
+		return n, true
+	}
+
+	var ok bool
+	if p.X[axis] < n.point.X[axis] {
+		n.Left, ok = remove(n.Left, nextAxis, p, index)
+	} else if p.X[axis] > n.point.X[axis] {
+		n.Right, ok = remove(n.Right, nextAxis, p, index)
+	} else {
+		// equal values may end up on either side
+		if n.Left, ok = remove(n.Left, nextAxis, p, index); !ok {
+			n.Right, ok = remove(n.Right, nextAxis, p, index)
+		}
+	}
+	return n, ok
+}
+
+// findMin finds the node with the smallest value of dimension dim in the subtree splitting on axis.
+func findMin(n *node, dim, axis int) *node {
+	if n == nil {
+		return nil
+	}
+	nextAxis := (axis + 1) % n.point.N
+	left := findMin(n.Left, dim, nextAxis)
+	if axis == dim {
+		if left == nil {
+			return n
+		}
+		return left
+	}
+	min := n
+	for _, m := range []*node{left, findMin(n.Right, dim, nextAxis)} {
+		if m != nil && m.point.X[dim] < min.point.X[dim] {
+			min = m
+		}
+	}
+	return min
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"image"
+	"sort"
+)
+
+// octreeDepth the depth of the octree, one level per bit of the 8-bit colors.
+const octreeDepth = 8
+
+// Octree generates A palette by sorting the pixel colors into A tree splitting on one bit of every channel per level,
+// then merging the least common leaves into their parents until there are few enough leaves.
+// Each leaf makes one color, the mean of its pixels. Faster than the others, with coarser colors.
+// See: https://en.wikipedia.org/wiki/Octree#Color_quantization
+type Octree struct {
+	Alpha bool // Alpha if true, generates transparent colors splitting on alpha too, otherwise opaque colors.
+}
+
+// Quantize generates at most n colors from the pixels of the images, ready for NewPalette with the same alpha.
+// Colors are ordered by the number of pixels they stand for, most first, and indexed from 0 in that order.
+// Without alpha, fully transparent pixels are left out.
+func (o Octree) Quantize(n int, images ...image.Image) []PaletteColor {
+	bins := histogram(images, o.Alpha)
+	if n < 1 || len(bins) == 0 {
+		return nil
+	}
+	channels := 3
+	if o.Alpha {
+		channels = 4
+	}
+
+	root := &octreeNode{}
+	levels := make([][]*octreeNode, octreeDepth) // levels inner nodes at each level
+	leaves := 0
+	for _, b := range bins {
+		current := root
+		for level := 0; level < octreeDepth; level++ {
+			current.add(b)
+			if current.children == nil {
+				current.children = make([]*octreeNode, 1<<channels)
+				levels[level] = append(levels[level], current)
+			}
+			child := 0
+			for c := 0; c < channels; c++ {
+				child = child<<1 | int(b.key>>(8*(3-c)+7-level)&1)
+			}
+			if current.children[child] == nil {
+				current.children[child] = &octreeNode{}
+			}
+			current = current.children[child]
+		}
+		current.add(b) // each bin has A distinct 8-bit color, so A leaf of its own
+		leaves++
+	}
+
+	// merge the deepest nodes first, the least common first within A level
+	for level := octreeDepth - 1; level >= 0 && leaves > n; level-- {
+		nodes := levels[level]
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].count < nodes[j].count
+		})
+		for _, node := range nodes {
+			if leaves <= n {
+				break
+			}
+			leaves -= node.merge() - 1
+		}
+	}
+
+	var counts []int
+	var values [][4]float64
+	root.leaves(&counts, &values)
+	return byCount(counts, values, o.Alpha)
+}
+
+// octreeNode A node of the Octree, adding up the pixels of its subtree.
+type octreeNode struct {
+	sum      [4]float64
+	count    int
+	children []*octreeNode // children nil for leaves
+}
+
+func (n *octreeNode) add(b bin) {
+	for d := range n.sum {
+		n.sum[d] += b.sum[d]
+	}
+	n.count += b.count
+}
+
+// merge turns the node into A leaf. Its children must be leaves. Returns the number of children merged.
+func (n *octreeNode) merge() int {
+	merged := 0
+	for _, c := range n.children {
+		if c != nil {
+			merged++
+		}
+	}
+	n.children = nil
+	return merged
+}
+
+// leaves appends the pixel counts and mean values of the leaves in the subtree.
+func (n *octreeNode) leaves(counts *[]int, values *[][4]float64) {
+	if n.children == nil {
+		c := float64(n.count)
+		*counts = append(*counts, n.count)
+		*values = append(*values, [4]float64{n.sum[0] / c, n.sum[1] / c, n.sum[2] / c, n.sum[3] / c})
+		return
+	}
+	for _, c := range n.children {
+		if c != nil {
+			c.leaves(counts, values)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"fmt"
+	"math"
+)
+
+// Oklab is the straight-line distance in the Oklab space, which behaves uniformly across hues.
+// Colors implementing Oklab() (L, a, b float64), like ColorOklab, are used as is, others are converted from sRGB.
+// See: https://bottosson.github.io/posts/oklab/
+var Oklab Metric = oklab{}
+
+// oklabColor is implemented by colors which know their own Oklab coordinates.
+type oklabColor interface {
+	Oklab() (float64, float64, float64)
+}
+
+// rgbColor is implemented by colors which compute their RGB dimensions, like ColorOklab, to compute them only once.
+type rgbColor interface {
+	rgb() (uint32, uint32, uint32)
+}
+
+// rgbDimensions returns the first three dimensions of A color, computing them only once for A rgbColor.
+func rgbDimensions(c Color) (uint32, uint32, uint32) {
+	if o, ok := c.(rgbColor); ok {
+		return o.rgb()
+	}
+	return c.Dimension(0), c.Dimension(1), c.Dimension(2)
+}
+
+// oklab is the Metric behind Oklab.
+type oklab struct{}
+
+func (oklab) Project(c Color) Point {
+	p := Point{N: c.Dimensions()}
+	if o, ok := c.(oklabColor); ok {
+		p.X[0], p.X[1], p.X[2] = o.Oklab()
+	} else {
+		p.X[0], p.X[1], p.X[2] = rgbToOklab(c.Dimension(0), c.Dimension(1), c.Dimension(2))
+	}
+	if p.N > 3 {
+		p.X[3] = float64(clamp16(c.Dimension(3))) / 0xffff
+	}
+	return p
+}
+
+func (oklab) projectRGBA(c ColorRGBA) Point {
+	p := Point{N: 3}
+	p.X[0], p.X[1], p.X[2] = rgbToOklab(c.R, c.G, c.B)
+	if c.AlphaChannel {
+		p.X[3], p.N = float64(clamp16(c.A))/0xffff, 4
+	}
+	return p
+}
+
+func (oklab) Distance(q, p Point) float64 {
+	return euclidean(q, p)
+}
+
+func (oklab) PlaneDistance(q Point, plane float64, axis int) float64 {
+	return math.Abs(q.X[axis] - plane)
+}
+
+// ColorOklab Color implementation in the Oklab space.
+// Dimensions are still reported in the 16-bit RGBA space like ColorRGBA, so it can be used with any Metric.
+type ColorOklab struct {
+	L, A, B      float64 // L is the lightness in range [0-1], A and B are the green-red and blue-yellow axes.
+	Alpha        float64 // Alpha is the opacity in range [0-1].
+	AlphaChannel bool    // If false, alpha values are ignored.
+}
+
+// Oklab returns the L, a and b coordinates of the color.
+func (c ColorOklab) Oklab() (float64, float64, float64) {
+	return c.L, c.A, c.B
+}
+
+// LCh returns the color in the OkLCh space, as lightness, chroma and hue in degrees [0-360).
+func (c ColorOklab) LCh() (float64, float64, float64) {
+	return c.L, math.Hypot(c.A, c.B), hueAngle(c.A, c.B)
+}
+
+// color.Color implementation
+func (c ColorOklab) RGBA() (uint32, uint32, uint32, uint32) {
+	r, g, b := c.rgb()
+	if c.AlphaChannel {
+		return r, g, b, c.alpha()
+	}
+	return r, g, b, 0xffff
+}
+
+func (c ColorOklab) Dimensions() int {
+	if c.AlphaChannel {
+		return 4
+	}
+	return 3
+}
+
+// Dimension converts the color into sRGB on every call for R, G and B. The built-in metrics convert it only once.
+func (c ColorOklab) Dimension(i int) uint32 {
+	switch i {
+	case 0, 1, 2:
+		r, g, b := c.rgb()
+		return [3]uint32{r, g, b}[i]
+	case 3:
+		if c.AlphaChannel {
+			return c.alpha()
+		}
+		fallthrough
+	default:
+		panic(fmt.Errorf("invalid dimension %d: expected [0-%d]", i, c.Dimensions()))
+	}
+}
+
+// rgb converts the color into 16-bit sRGB values.
+func (c ColorOklab) rgb() (uint32, uint32, uint32) {
+	return oklabToRGB(c.L, c.A, c.B)
+}
+
+func (c ColorOklab) alpha() uint32 {
+	return uint32(math.Round(math.Max(0, math.Min(1, c.Alpha)) * 0xffff))
+}
+
+func (c ColorOklab) String() string {
+	if c.AlphaChannel {
+		return fmt.Sprintf("{L:%f, a:%f, b:%f, A:%f}", c.L, c.A, c.B, c.Alpha)
+	}
+	return fmt.Sprintf("{L:%f, a:%f, b:%f}", c.L, c.A, c.B)
+}
+
+// NewOklabColor creates an opaque color from Oklab coordinates.
+func NewOklabColor(L, a, b float64) ColorOklab {
+	return ColorOklab{L: L, A: a, B: b, Alpha: 1}
+}
+
+// NewOklchColor creates an opaque color from OkLCh coordinates, h being the hue in degrees.
+func NewOklchColor(L, C, h float64) ColorOklab {
+	return NewOklabColor(L, C*math.Cos(radians(h)), C*math.Sin(radians(h)))
+}
+
+// ToOklab converts any Color into ColorOklab. The alpha channel is kept if the color has one.
+func ToOklab(c Color) ColorOklab {
+	if o, ok := c.(ColorOklab); ok {
+		return o
+	}
+	o := ColorOklab{Alpha: 1}
+	o.L, o.A, o.B = rgbToOklab(c.Dimension(0), c.Dimension(1), c.Dimension(2))
+	if c.Dimensions() > 3 {
+		o.Alpha = float64(clamp16(c.Dimension(3))) / 0xffff
+		o.AlphaChannel = true
+	}
+	return o
+}
+
+// IndexedColorOklab Oklab based PaletteColor implementation.
+type IndexedColorOklab struct {
+	ColorOklab
+	Id   int    // Id is the color's unique index
+	Name string // A human readable name. Used in stringer
+}
+
+func (ic IndexedColorOklab) Index() int {
+	return ic.Id
+}
+
+func (ic IndexedColorOklab) String() string {
+	return fmt.Sprintf("%s(%d)", ic.Name, ic.Id)
+}
+
+// NewOklabPaletteColor creates an opaque palette color from Oklab coordinates.
+// id is the unique id for the color across the palette.
+// name is just any human readable identifier, no need to be unique.
+func NewOklabPaletteColor(L, a, b float64, id int, name string) IndexedColorOklab {
+	return IndexedColorOklab{
+		Id:         id,
+		Name:       name,
+		ColorOklab: NewOklabColor(L, a, b),
+	}
+}
+
+// NewOklabPalette creates A palette searching in the Oklab space.
+// Palette colors and the colors to be converted are projected into Oklab, unless they are already ColorOklab.
+func NewOklabPalette(colors []PaletteColor, alpha bool, opts ...Option) *Palette {
+	return NewPalette(colors, alpha, append([]Option{WithMetric(Oklab)}, opts...)...)
+}
+
+// rgbToOklab converts 16-bit sRGB values into Oklab coordinates.
+func rgbToOklab(r, g, b uint32) (float64, float64, float64) {
+	lr, lg, lb := linearize(r), linearize(g), linearize(b)
+	l := math.Cbrt(0.4122214708*lr + 0.5363325363*lg + 0.0514459929*lb)
+	m := math.Cbrt(0.2119034982*lr + 0.6806995451*lg + 0.1073969566*lb)
+	s := math.Cbrt(0.0883024619*lr + 0.2817188376*lg + 0.6299787005*lb)
+	return 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s
+}
+
+// oklabToRGB converts Oklab coordinates into 16-bit sRGB values, clipping colors outside the gamut.
+func oklabToRGB(L, a, b float64) (uint32, uint32, uint32) {
+	l := L + 0.3963377774*a + 0.2158037573*b
+	m := L - 0.1055613458*a - 0.0638541728*b
+	s := L - 0.0894841775*a - 1.2914855480*b
+	l, m, s = l*l*l, m*m*m, s*s*s
+	return delinearize(4.0767416621*l - 3.3077115913*m + 0.2309699292*s),
+		delinearize(-1.2684380046*l + 2.6097574011*m - 0.3413193965*s),
+		delinearize(-0.0041960863*l - 0.7034186147*m + 1.7076147010*s)
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+//
+// Palette files of pixel art tools. All of these hold unnamed colors, read into IndexedColorRGBA with sequential Ids
+// from 0 in file order, and written in the order of Indexes.
+//
+
+const (
+	jascMagic   = "JASC-PAL"
+	jascVersion = "0100"
+
+	riffPalVersion = 0x0300
+)
+
+// DecodeJASC reads A JASC-PAL(Paint Shop Pro) palette file of opaque colors.
+func DecodeJASC(r io.Reader) ([]PaletteColor, error) {
+	s := bufio.NewScanner(r)
+	var header [3]string
+	for i := range header {
+		if !s.Scan() {
+			if err := s.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("not A JASC palette")
+		}
+		header[i] = strings.TrimSpace(s.Text())
+	}
+	if strings.TrimPrefix(header[0], "\uFEFF") != jascMagic {
+		return nil, errors.New("not A JASC palette")
+	}
+	if header[1] != jascVersion {
+		return nil, fmt.Errorf("unsupported JASC palette version %q", header[1])
+	}
+	count, err := strconv.Atoi(header[2])
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid color count %q", header[2])
+	}
+	var colors []PaletteColor // not preallocated, the count is untrusted
+	for line := 4; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: invalid color %q", line, text)
+		}
+		var rgb [3]int
+		for i := range rgb {
+			if rgb[i], err = strconv.Atoi(fields[i]); err != nil || rgb[i] < 0 || rgb[i] > 255 {
+				return nil, fmt.Errorf("line %d: invalid color %q", line, text)
+			}
+		}
+		colors = append(colors, NewOpaquePaletteColor(rgb[0], rgb[1], rgb[2], len(colors), ""))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(colors) != count {
+		return nil, fmt.Errorf("color count mismatch: expected %d, got %d", count, len(colors))
+	}
+	return colors, nil
+}
+
+// EncodeJASC writes the colors of the palette as A JASC-PAL palette file. Alpha values are left out.
+func EncodeJASC(w io.Writer, t *Palette) error {
+	colors := t.colors()
+	b := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(b, "%s\r\n%s\r\n%d\r\n", jascMagic, jascVersion, len(colors))
+	for _, c := range colors {
+		r, g, bl := rgb8(c)
+		_, _ = fmt.Fprintf(b, "%d %d %d\r\n", r, g, bl)
+	}
+	return b.Flush()
+}
+
+// DecodeRIFF reads A Microsoft RIFF palette(.pal) file of opaque colors. Chunks other than the palette data are skipped.
+func DecodeRIFF(r io.Reader) ([]PaletteColor, error) {
+	br := bufio.NewReader(r)
+	var header struct {
+		Riff [4]byte
+		Size uint32
+		Form [4]byte
+	}
+	if err := binary.Read(br, binary.LittleEndian, &header); err != nil ||
+		string(header.Riff[:]) != "RIFF" || string(header.Form[:]) != "PAL " {
+		return nil, errors.New("not A RIFF palette")
+	}
+	for {
+		var chunk struct {
+			Id   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(br, binary.LittleEndian, &chunk); err != nil {
+			return nil, errors.New("RIFF palette without data")
+		}
+		if string(chunk.Id[:]) != "data" {
+			// chunks are padded to even sizes
+			if _, err := io.CopyN(ioutil.Discard, br, int64(chunk.Size)+int64(chunk.Size%2)); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(br, int64(chunk.Size)))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != int(chunk.Size) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if len(data) < 4 || binary.LittleEndian.Uint16(data) != riffPalVersion {
+			return nil, errors.New("unsupported RIFF palette version")
+		}
+		count := int(binary.LittleEndian.Uint16(data[2:]))
+		if len(data) < 4+4*count {
+			return nil, io.ErrUnexpectedEOF
+		}
+		colors := make([]PaletteColor, count)
+		for i := range colors {
+			entry := data[4+4*i:]
+			colors[i] = NewOpaquePaletteColor(int(entry[0]), int(entry[1]), int(entry[2]), i, "")
+		}
+		return colors, nil
+	}
+}
+
+// EncodeRIFF writes the colors of the palette as A Microsoft RIFF palette file. Alpha values are left out.
+func EncodeRIFF(w io.Writer, t *Palette) error {
+	colors := t.colors()
+	if len(colors) > 0xffff {
+		return fmt.Errorf("too many colors for A RIFF palette: %d", len(colors))
+	}
+	size := uint32(4 + 4*len(colors))
+	b := bufio.NewWriter(w)
+	_, _ = b.WriteString("RIFF")
+	_ = binary.Write(b, binary.LittleEndian, uint32(4+8+size))
+	_, _ = b.WriteString("PAL data")
+	_ = binary.Write(b, binary.LittleEndian, size)
+	_ = binary.Write(b, binary.LittleEndian, []uint16{riffPalVersion, uint16(len(colors))})
+	for _, c := range colors {
+		r, g, bl := rgb8(c)
+		_, _ = b.Write([]byte{r, g, bl, 0})
+	}
+	return b.Flush()
+}
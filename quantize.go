@@ -0,0 +1,164 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+	"sort"
+)
+
+// Generator generates A palette from the pixels of one or more images. See MedianCut, KMeans, Octree and Wu.
+type Generator interface {
+
+	// Quantize generates at most n colors from the pixels of the images, indexed from 0.
+	Quantize(n int, images ...image.Image) []PaletteColor
+}
+
+//
+// Shared parts of the palette generators.
+//
+
+// bin A group of pixels with the same 8-bit color in A color histogram.
+type bin struct {
+	key   uint32     // key the 8-bit color of the pixels
+	sum   [4]float64 // sum of the 16-bit RGBA values of the pixels
+	count int        // count of pixels
+}
+
+// mean returns the mean RGBA values of the pixels in the bin.
+func (b bin) mean() [4]float64 {
+	n := float64(b.count)
+	return [4]float64{b.sum[0] / n, b.sum[1] / n, b.sum[2] / n, b.sum[3] / n}
+}
+
+// histogram groups the pixels of the images by their 8-bit colors, ordered by color.
+// Pixels are read as premultiplied RGBA like the colors converted by A Palette.
+// Without alpha, fully transparent pixels are left out and the alpha of others is ignored.
+func histogram(images []image.Image, alpha bool) []bin {
+	h := histogramBuilder{alpha: alpha, bins: make(map[uint32]*bin)}
+	for _, img := range images {
+		read := newPixelReader(img)
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				h.add(read.at(x, y))
+			}
+		}
+	}
+	return h.sorted()
+}
+
+// sampleHistogram is histogram of n pixels picked at random from all the images, or of all the pixels if there are fewer.
+func sampleHistogram(images []image.Image, alpha bool, n int, rng *rand.Rand) []bin {
+	total := 0
+	for _, img := range images {
+		total += img.Bounds().Dx() * img.Bounds().Dy()
+	}
+	if n >= total {
+		return histogram(images, alpha)
+	}
+	readers := make([]pixelReader, len(images))
+	for i, img := range images {
+		readers[i] = newPixelReader(img)
+	}
+	h := histogramBuilder{alpha: alpha, bins: make(map[uint32]*bin)}
+	for s := 0; s < n; s++ {
+		pixel := rng.Intn(total)
+		for i, img := range images {
+			b := img.Bounds()
+			if pixel < b.Dx()*b.Dy() {
+				h.add(readers[i].at(b.Min.X+pixel%b.Dx(), b.Min.Y+pixel/b.Dx()))
+				break
+			}
+			pixel -= b.Dx() * b.Dy()
+		}
+	}
+	return h.sorted()
+}
+
+// histogramBuilder collects the pixels of A histogram.
+type histogramBuilder struct {
+	alpha bool
+	bins  map[uint32]*bin
+}
+
+func (h *histogramBuilder) add(r, g, b, a uint32) {
+	if !h.alpha {
+		if a == 0 {
+			return
+		}
+		a = 0xffff
+	}
+	key := r>>8<<24 | g>>8<<16 | b>>8<<8 | a>>8
+	c, ok := h.bins[key]
+	if !ok {
+		c = &bin{key: key}
+		h.bins[key] = c
+	}
+	c.sum[0] += float64(r)
+	c.sum[1] += float64(g)
+	c.sum[2] += float64(b)
+	c.sum[3] += float64(a)
+	c.count++
+}
+
+// sorted returns the bins ordered by color.
+func (h *histogramBuilder) sorted() []bin {
+	res := make([]bin, 0, len(h.bins))
+	for _, c := range h.bins {
+		res = append(res, *c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].key < res[j].key
+	})
+	return res
+}
+
+// byCount orders the given pixel counts and colors by the counts, most first, and creates the palette colors
+// indexed from 0 in that order.
+func byCount(counts []int, values [][4]float64, alpha bool) []PaletteColor {
+	order := make([]int, len(counts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+	colors := make([]PaletteColor, len(order))
+	for i, o := range order {
+		colors[i] = newGeneratedColor(i, values[o], alpha)
+	}
+	return colors
+}
+
+// newGeneratedColor creates the palette color with the given id from RGBA values, named after its hex code.
+func newGeneratedColor(id int, v [4]float64, alpha bool) IndexedColorRGBA {
+	c := ColorRGBA{
+		R:            uint32(clamp(v[0]) + 0.5),
+		G:            uint32(clamp(v[1]) + 0.5),
+		B:            uint32(clamp(v[2]) + 0.5),
+		A:            0xffff,
+		AlphaChannel: alpha,
+	}
+	name := fmt.Sprintf("#%02X%02X%02X", c.R>>8, c.G>>8, c.B>>8)
+	if alpha {
+		c.A = uint32(clamp(v[3]) + 0.5)
+		name += fmt.Sprintf("%02X", c.A>>8)
+	}
+	return IndexedColorRGBA{ColorRGBA: c, Id: id, Name: name}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+
+package treepalette_test
+
+import (
+	"github.com/philoj/tree-palette"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// blocksImage creates an image with A column of pixels for each color, the i-th column being i+1 pixels wide.
+func blocksImage(colors ...color.Color) *image.NRGBA {
+	width := len(colors) * (len(colors) + 1) / 2
+	img := image.NewNRGBA(image.Rect(0, 0, width, 4))
+	x := 0
+	for i, c := range colors {
+		for end := x + i + 1; x < end; x++ {
+			for y := 0; y < 4; y++ {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+// noiseImage creates an image of random colors.
+func noiseImage(seed int64, w, h int) *image.RGBA {
+	r := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(r.Intn(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+// quantizationError sums the distances between the pixels of the image and their closest colors.
+func quantizationError(colors []treepalette.PaletteColor, img image.Image) float64 {
+	return paletteError(treepalette.NewPalette(colors, false), img)
+}
+
+// paletteError sums the distances between the pixels of the image and their closest colors in the palette.
+func paletteError(p *treepalette.Palette, img image.Image) float64 {
+	var sum float64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := treepalette.ColorRGBA{}
+			c.R, c.G, c.B, c.A = img.At(x, y).RGBA()
+			sum += p.ConvertColorWithDistance(c).Distance
+		}
+	}
+	return sum
+}
+
+func TestMedianCut(t *testing.T) {
+	img := blocksImage(
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{G: 255, A: 255},
+		color.NRGBA{B: 255, A: 255},
+		color.NRGBA{R: 10, G: 20, B: 30, A: 255},
+		color.NRGBA{R: 99, G: 99, B: 99}, // fully transparent
+	)
+	colors := treepalette.MedianCut{}.Quantize(4, img)
+	assert.Equal(t, []treepalette.PaletteColor{
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0x0a0a, G: 0x1414, B: 0x1e1e, A: 0xffff}, Id: 0, Name: "#0A141E"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{B: 0xffff, A: 0xffff}, Id: 1, Name: "#0000FF"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0xffff, A: 0xffff}, Id: 2, Name: "#00FF00"},
+		treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0xffff, A: 0xffff}, Id: 3, Name: "#FF0000"},
+	}, colors)
+
+	// fewer colors than asked for
+	assert.Len(t, treepalette.MedianCut{}.Quantize(16, img), 4)
+	assert.Len(t, treepalette.MedianCut{Alpha: true}.Quantize(16, img), 5)
+	assert.Nil(t, treepalette.MedianCut{}.Quantize(0, img))
+
+	transparent := treepalette.MedianCut{Alpha: true}.Quantize(5, img)
+	assert.Equal(t, treepalette.IndexedColorRGBA{
+		ColorRGBA: treepalette.ColorRGBA{AlphaChannel: true},
+		Id:        0,
+		Name:      "#00000000",
+	}, transparent[0])
+
+	// more colors fit the image better
+	noise := noiseImage(3, 64, 64)
+	previous := quantizationError(treepalette.MedianCut{}.Quantize(2, noise), noise)
+	for _, n := range []int{4, 16, 64} {
+		colors := treepalette.MedianCut{}.Quantize(n, noise, noise)
+		assert.Len(t, colors, n)
+		e := quantizationError(colors, noise)
+		assert.Less(t, e, previous)
+		previous = e
+	}
+}
+
+func TestKMeans(t *testing.T) {
+	img := blocksImage(
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{G: 255, A: 255},
+		color.NRGBA{B: 255, A: 255},
+		color.NRGBA{R: 10, G: 20, B: 30, A: 255},
+	)
+	for _, m := range []treepalette.Metric{nil, treepalette.CIE76, treepalette.CIEDE2000, treepalette.Oklab} {
+		colors := treepalette.KMeans{Metric: m}.Quantize(4, img)
+		var names []string
+		for _, c := range colors {
+			names = append(names, c.(treepalette.IndexedColorRGBA).Name)
+		}
+		assert.Equal(t, []string{"#0A141E", "#0000FF", "#00FF00", "#FF0000"}, names)
+		assert.Len(t, treepalette.KMeans{Metric: m}.Quantize(2, img), 2)
+	}
+
+	noise := noiseImage(5, 64, 64)
+	k := treepalette.KMeans{Seed: 11, MaxIterations: 50}
+	colors := k.Quantize(16, noise)
+	assert.Len(t, colors, 16)
+	assert.Equal(t, colors, k.Quantize(16, noise))
+	assert.Less(t, quantizationError(colors, noise), quantizationError(treepalette.MedianCut{}.Quantize(16, noise), noise))
+
+	k = treepalette.KMeans{Metric: treepalette.Oklab, Seed: 11, MaxSamples: 500, Tolerance: 0.001}
+	colors = k.Quantize(8, noise, noiseImage(6, 32, 32))
+	assert.Len(t, colors, 8)
+	assert.Equal(t, colors, k.Quantize(8, noise, noiseImage(6, 32, 32)))
+}
+
+func TestGenerators(t *testing.T) {
+	img := blocksImage(
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{G: 255, A: 255},
+		color.NRGBA{B: 255, A: 255},
+		color.NRGBA{R: 10, G: 20, B: 30, A: 255},
+		color.NRGBA{R: 99, G: 99, B: 99}, // fully transparent
+	)
+	noise := noiseImage(7, 64, 64)
+	for _, q := range []treepalette.Generator{
+		treepalette.MedianCut{},
+		treepalette.KMeans{Seed: 1},
+		treepalette.Octree{},
+		treepalette.Wu{},
+	} {
+		colors := q.Quantize(4, img)
+		var names []string
+		for i, c := range colors {
+			assert.Equal(t, i, c.Index())
+			names = append(names, c.(treepalette.IndexedColorRGBA).Name)
+		}
+		assert.Equal(t, []string{"#0A141E", "#0000FF", "#00FF00", "#FF0000"}, names, "%T", q)
+		assert.Len(t, q.Quantize(1, img), 1)
+		assert.Nil(t, q.Quantize(0, img))
+
+		coarse := q.Quantize(4, noise)
+		fine := q.Quantize(32, noise)
+		assert.True(t, len(fine) > 16 && len(fine) <= 32, "%T generated %d colors", q, len(fine))
+		assert.Less(t, quantizationError(fine, noise), quantizationError(coarse, noise), "%T", q)
+	}
+
+	transparent := treepalette.Octree{Alpha: true}.Quantize(5, img)
+	assert.Len(t, transparent, 5)
+	assert.Equal(t, "#00000000", transparent[0].(treepalette.IndexedColorRGBA).Name)
+}
+
+func TestRefiner(t *testing.T) {
+	img := blocksImage(
+		color.NRGBA{R: 200, A: 255},
+		color.NRGBA{G: 255, A: 255},
+		color.NRGBA{B: 255, A: 255},
+	)
+	colors := []treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 7, "brand red"),
+		treepalette.NewOpaquePaletteColor(10, 100, 10, 8, "free"),
+		treepalette.NewOpaquePaletteColor(10, 10, 100, 9, "free"),
+		treepalette.NewOpaquePaletteColor(255, 255, 255, 10, "unused"),
+	}
+	palette := treepalette.NewPalette(colors, false)
+	refined, err := treepalette.Refiner{Locked: []int{7}}.Refine(palette, img)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{7, 8, 9, 10}, refined.Indexes())
+	assert.Equal(t, colors[0], refined.ConvertColor(treepalette.NewOpaqueColor(200, 0, 0)))
+	assert.Equal(t, treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0xffff, A: 0xffff}, Id: 8, Name: "free"},
+		refined.ConvertColor(treepalette.NewOpaqueColor(0, 250, 0)))
+	assert.Equal(t, treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{B: 0xffff, A: 0xffff}, Id: 9, Name: "free"},
+		refined.ConvertColor(treepalette.NewOpaqueColor(0, 0, 250)))
+	assert.Equal(t, colors[3], refined.ConvertColor(treepalette.NewOpaqueColor(250, 250, 250)))
+	// the original palette is untouched
+	assert.Equal(t, colors[1], palette.ConvertColor(treepalette.NewOpaqueColor(0, 250, 0)))
+
+	// unlocked, the red moves too
+	refined, err = treepalette.Refiner{}.Refine(palette, img)
+	assert.NoError(t, err)
+	assert.Equal(t, treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{R: 0xc8c8, A: 0xffff}, Id: 7, Name: "brand red"},
+		refined.ConvertColor(treepalette.NewOpaqueColor(255, 0, 0)))
+
+	_, err = treepalette.Refiner{Locked: []int{1}}.Refine(palette, img)
+	assert.Error(t, err)
+
+	// named pointers and Oklab colors keep their names and types
+	green, blue := treepalette.NewOpaquePaletteColor(10, 100, 10, 8, "free green"), treepalette.NewOklabPaletteColor(0.3, 0, -0.1, 9, "free blue")
+	refined, err = treepalette.Refiner{Locked: []int{7}}.Refine(treepalette.NewPalette([]treepalette.PaletteColor{
+		colors[0], &green, &blue, colors[3],
+	}, false), img)
+	assert.NoError(t, err)
+	assert.Equal(t, &treepalette.IndexedColorRGBA{ColorRGBA: treepalette.ColorRGBA{G: 0xffff, A: 0xffff}, Id: 8, Name: "free green"},
+		refined.ConvertColor(treepalette.NewOpaqueColor(0, 250, 0)))
+	refinedBlue := refined.ConvertColor(treepalette.NewOpaqueColor(0, 0, 250))
+	if assert.IsType(t, &treepalette.IndexedColorOklab{}, refinedBlue) {
+		assert.Equal(t, "free blue", refinedBlue.(*treepalette.IndexedColorOklab).Name)
+		assert.Equal(t, treepalette.ToOklab(treepalette.NewOpaqueColor(0, 0, 255)), refinedBlue.(*treepalette.IndexedColorOklab).ColorOklab)
+	}
+	oklabPalette := treepalette.NewOklabPalette([]treepalette.PaletteColor{green, blue}, false)
+	refined, err = treepalette.Refiner{}.Refine(oklabPalette, img)
+	assert.NoError(t, err)
+	assert.IsType(t, treepalette.IndexedColorRGBA{}, refined.ConvertColor(treepalette.NewOpaqueColor(0, 250, 0)))
+	assert.IsType(t, treepalette.IndexedColorOklab{}, refined.ConvertColor(treepalette.NewOpaqueColor(0, 0, 250)))
+
+	// refining A generated palette fits the image better
+	noise := noiseImage(9, 64, 64)
+	generated := treepalette.MedianCut{}.Quantize(16, noise)
+	refined, err = treepalette.Refiner{Locked: []int{0, 1}, MaxSamples: 2000, Seed: 3}.
+		Refine(treepalette.NewPalette(generated, false), noise)
+	assert.NoError(t, err)
+	assert.Equal(t, generated[0], refined.ConvertColor(generated[0]))
+	assert.Equal(t, generated[1], refined.ConvertColor(generated[1]))
+	assert.Less(t, paletteError(refined, noise), quantizationError(generated, noise))
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+)
+
+// Refiner adjusts the colors of an existing palette to the pixels of one or more images by Lloyd iterations,
+// keeping the locked colors as they are. It fits A fixed brand palette with A few free colors to the images.
+type Refiner struct {
+	Locked        []int   // Locked indexes of the palette colors which never change
+	MaxIterations int     // MaxIterations limits the number of iterations. Defaults to 20.
+	Tolerance     float64 // Tolerance stops the iterations once no color moves further than this, measured by the Metric.
+	Seed          int64   // Seed of the random choices of pixels when sampling.
+	MaxSamples    int     // MaxSamples if positive, refines on only this many pixels picked at random.
+}
+
+// Refine returns A new palette with the unlocked colors of the given palette moved to the mean of the pixels closest
+// to them. Every color keeps its index, and its name and type if it is an IndexedColorRGBA or IndexedColorOklab
+// or A pointer to one. Other colors come back as IndexedColorRGBA. Colors closest to no pixel are left as they are.
+// The new palette has the same alpha and options. Fails if A locked index is not in the palette.
+func (r Refiner) Refine(t *Palette, images ...image.Image) (*Palette, error) {
+	for _, index := range r.Locked {
+		if _, ok := t.lookup[index]; !ok {
+			return nil, fmt.Errorf("index %d not found in the palette", index)
+		}
+	}
+	var bins []bin
+	if r.MaxSamples > 0 {
+		bins = sampleHistogram(images, t.alpha, r.MaxSamples, rand.New(rand.NewSource(r.Seed)))
+	} else {
+		bins = histogram(images, t.alpha)
+	}
+	refined := t.Clone()
+	if len(bins) == 0 || t.root == nil {
+		return refined, nil
+	}
+	iterations := r.MaxIterations
+	if iterations <= 0 {
+		iterations = defaultIterations
+	}
+
+	locked := make(map[int]bool, len(r.Locked))
+	for _, index := range r.Locked {
+		locked[index] = true
+	}
+	c := newClustering(bins, t.metric, t.alpha)
+	c.pinned = make(map[int]ColorRGBA)
+	indexes := t.Indexes()
+	for i, index := range indexes {
+		rgba := c.color(rgbaValues(t.lookup[index]))
+		if locked[index] {
+			c.pinned[i] = rgba
+		}
+		c.centers = append(c.centers, c.space.project(rgbaValues(rgba)))
+	}
+	c.run(iterations, r.Tolerance)
+
+	counts := make([]int, len(c.centers))
+	for i := range c.bins {
+		counts[c.assigned[i]]++
+	}
+	for i, index := range indexes {
+		if locked[index] || counts[i] == 0 {
+			continue
+		}
+		refined.lookup[index] = c.refinedColor(t.lookup[index], c.centers[i])
+	}
+	var nodes []node
+	for _, index := range indexes {
+		p := refined.lookup[index]
+		nodes = append(nodes, node{PaletteColor: p, point: project(refined.metric, p, refined.alpha)})
+	}
+	refined.root = newColorTree(nodes, 0)
+	refined.invalidate()
+	return refined, nil
+}
+
+// refinedColor creates the palette color at the given center, with the index and name of the original color.
+// IndexedColorRGBA and IndexedColorOklab colors, and pointers to them, keep their type. Other colors are replaced
+// by IndexedColorRGBA.
+func (c *clustering) refinedColor(original PaletteColor, center [4]float64) PaletteColor {
+	generated := newGeneratedColor(original.Index(), c.space.unproject(center), c.alpha)
+	switch o := original.(type) {
+	case IndexedColorRGBA:
+		generated.Name = o.Name
+	case *IndexedColorRGBA:
+		generated.Name = o.Name
+		return &generated
+	case IndexedColorOklab:
+		return IndexedColorOklab{ColorOklab: ToOklab(generated.ColorRGBA), Id: o.Id, Name: o.Name}
+	case *IndexedColorOklab:
+		return &IndexedColorOklab{ColorOklab: ToOklab(generated.ColorRGBA), Id: o.Id, Name: o.Name}
+	}
+	return generated
+}
+
+// rgbaValues returns the RGBA values of A color as floats, opaque if it has no alpha dimension.
+func rgbaValues(c Color) [4]float64 {
+	r, g, b := rgbDimensions(c)
+	v := [4]float64{float64(r), float64(g), float64(b), 0xffff}
+	if c.Dimensions() > 3 {
+		v[3] = float64(c.Dimension(3))
+	}
+	return v
+}
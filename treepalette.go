@@ -18,141 +18,319 @@
 package treepalette
 
 import (
+	"container/heap"
 	"fmt"
+	"image/color"
 	"math"
 	"sort"
 )
 
+// Unmatched is the index used for colors which are farther than the threshold from every palette color.
+// Palette colors must not use it as their Index. See WithThreshold.
+const Unmatched = -1
+
 // Palette implements A kd-tree data structure to quickly convert any given color into the closest palette color.
-// Closeness is calculated as the spatial closeness in the RGBA space.
+// Closeness is measured by the Metric of the palette, which is the spatial closeness in the RGBA space by default.
 // See: https://en.wikipedia.org/wiki/K-d_tree
 type Palette struct {
-	alpha  bool                 // alpha if false, ignore alpha values
-	root   *node                // root the root node of the kd-tree
-	lookup map[int]PaletteColor // Lookup table
+	alpha    bool                 // alpha if false, ignore alpha values
+	metric   Metric               // metric measures the closeness of colors
+	limit    float64              // limit colors at this distance or farther are unmatched
+	fallback color.Color          // fallback is the color.Model output for unmatched colors
+	cache    *lookupCache         // cache optional memo of lookups
+	lut      *LUT                 // lut optional precomputed lookup table
+	root     *node                // root the root node of the kd-tree
+	lookup   map[int]PaletteColor // Lookup table
+}
+
+// Option configures A Palette during construction. See NewPalette.
+type Option func(*Palette)
+
+// WithMetric sets the Metric used to find the closest palette color. Defaults to EuclideanRGB.
+func WithMetric(m Metric) Option {
+	return func(t *Palette) {
+		t.metric = m
+	}
+}
+
+// WithThreshold sets the maximum distance, as measured by the Metric, at which A color still matches A palette color.
+// Colors farther than maxDist from every palette color are unmatched: ConvertColor returns nil for them,
+// Convert and ApplyPalette render them as fallback, and Rank counts them under the Unmatched index.
+// A nil fallback renders unmatched colors as color.Transparent.
+func WithThreshold(maxDist float64, fallback color.Color) Option {
+	return func(t *Palette) {
+		t.limit = math.Nextafter(maxDist, math.Inf(1))
+		if fallback != nil {
+			t.fallback = fallback
+		}
+	}
 }
 
 // node is the single node of the kd-tree, each of which represents A color in the indexed palette.
 type node struct {
-	PaletteColor // PaletteColor value of the node
+	PaletteColor       // PaletteColor value of the node
+	point        Point // point is the PaletteColor projected by the Metric of the palette
 	Left         *node
 	Right        *node
 }
 
-func newColorTree(points []PaletteColor, axis int) *node {
+func newColorTree(points []node, axis int) *node {
 	if len(points) == 0 {
 		return nil
 	}
 	if len(points) == 1 {
-		return &node{PaletteColor: points[0]}
+		return &points[0]
 	}
 
 	sort.Sort(&byDimension{dimension: axis, points: points})
 	mid := len(points) / 2
-	root := points[mid]
-	nextDim := (axis + 1) % root.Dimensions()
-	return &node{
-		PaletteColor: root,
-		Left:         newColorTree(points[:mid], nextDim),
-		Right:        newColorTree(points[mid+1:], nextDim),
-	}
+	root := &points[mid]
+	nextDim := (axis + 1) % root.point.N
+	root.Left = newColorTree(points[:mid], nextDim)
+	root.Right = newColorTree(points[mid+1:], nextDim)
+	return root
 }
 
 // ConvertColor finds the ConvertColor PaletteColor from the Palette
+// Returns nil if the palette is empty or the color is unmatched. See WithThreshold.
 func (t *Palette) ConvertColor(p Color) PaletteColor {
 	if t.root == nil || p == nil {
 		return nil
 	}
-	point, _ := nn(p, t.root, 0, nil, math.MaxUint32)
+	if t.lut != nil {
+		if index, ok := t.lut.convert(p); ok {
+			return t.lookup[index] // nil for Unmatched
+		}
+	}
+	point, _ := t.nearest(p)
 	return point
 }
 
+// ConvertColorWithDistance finds the closest PaletteColor from the Palette, along with its distance from the given color.
+// Color of the returned Match is nil if the palette is empty or the color is unmatched. See WithThreshold.
+func (t *Palette) ConvertColorWithDistance(p Color) Match {
+	if t.root == nil || p == nil {
+		return Match{}
+	}
+	c, d := t.nearest(p)
+	if c == nil {
+		return Match{}
+	}
+	return newMatch(p, c, d)
+}
+
+// nearest finds the closest PaletteColor within the threshold and its distance, going through the cache if any.
+func (t *Palette) nearest(p Color) (PaletteColor, float64) {
+	if rgba, ok := p.(ColorRGBA); ok {
+		return t.nearestRGBA(rgba)
+	}
+	return nn(t.metric, t.metric.Project(p), t.root, 0, nil, t.limit)
+}
+
+// nearestRGBA is nearest of A ColorRGBA, which is cached and projected without allocating.
+func (t *Palette) nearestRGBA(p ColorRGBA) (PaletteColor, float64) {
+	if t.cache != nil {
+		if k, ok := t.cache.key(p); ok {
+			if e, ok := t.cache.get(k); ok {
+				return e.color, e.distance
+			}
+			c, d := nn(t.metric, t.projectRGBA(p), t.root, 0, nil, t.limit)
+			t.cache.put(k, cacheEntry{color: c, distance: d})
+			return c, d
+		}
+	}
+	return nn(t.metric, t.projectRGBA(p), t.root, 0, nil, t.limit)
+}
+
+// projectRGBA projects A query color by the metric, without boxing it into A Color for the built-in metrics.
+func (t *Palette) projectRGBA(p ColorRGBA) Point {
+	if m, ok := t.metric.(rgbaProjector); ok {
+		return m.projectRGBA(p)
+	}
+	return t.metric.Project(p)
+}
+
 // nn implements the ConvertColor neighbour search in A kd-tree, finding only A single ConvertColor neighbour.
-// returns the closest PaletteColor and squared distance to it starting from the given start node
-func nn(p Color, start *node, currentAxis int, nearest PaletteColor, shortest uint32) (PaletteColor, uint32) {
-	if p == nil || start == nil {
-		panic(fmt.Errorf("nil value for either start:%v or p:%v", start, p))
+// returns the closest PaletteColor and the distance to it starting from the given start node
+func nn(m Metric, p Point, start *node, currentAxis int, nearest PaletteColor, shortest float64) (PaletteColor, float64) {
+	if start == nil {
+		panic(fmt.Errorf("nil value for start:%v", start))
 	}
 
-	var path []*node
+	path := make([]*node, 0, 32) // deep enough for balanced trees of 2^32 colors, kept off the heap
 	currentNode := start
+	dims := start.point.N
 
 	// 1. move down
 	for currentNode != nil {
 		path = append(path, currentNode)
-		if p.Dimension(currentAxis) < currentNode.Dimension(currentAxis) {
+		if p.X[currentAxis] < currentNode.point.X[currentAxis] {
 			currentNode = currentNode.Left
 		} else {
 			currentNode = currentNode.Right
 		}
-		currentAxis = (currentAxis + 1) % p.Dimensions()
+		currentAxis = (currentAxis + 1) % dims
 	}
 
 	// 2. move up
-	currentAxis = (currentAxis - 1 + p.Dimensions()) % p.Dimensions()
+	currentAxis = (currentAxis - 1 + dims) % dims
 	for path, currentNode = popLast(path); currentNode != nil; path, currentNode = popLast(path) {
-		currentDistance := squaredDistance(p, currentNode)
+		currentDistance := m.Distance(p, currentNode.point)
 		if currentDistance < shortest {
-			nearest, shortest = currentNode, currentDistance
+			nearest, shortest = currentNode.PaletteColor, currentDistance
 		}
 
 		// check other side of plane
-		if squaredPlaneDistance(p, currentNode.Dimension(currentAxis), currentAxis) < shortest {
+		if m.PlaneDistance(p, currentNode.point.X[currentAxis], currentAxis) < shortest {
 			var next *node
-			if p.Dimension(currentAxis) < currentNode.Dimension(currentAxis) {
+			if p.X[currentAxis] < currentNode.point.X[currentAxis] {
 				next = currentNode.Right
 			} else {
 				next = currentNode.Left
 			}
 			if next != nil {
 				// search down A potential branch
-				nearest, shortest = nn(p, next, (currentAxis+1)%p.Dimensions(), nearest, shortest)
+				nearest, shortest = nn(m, p, next, (currentAxis+1)%dims, nearest, shortest)
 			}
 		}
-		currentAxis = (currentAxis - 1 + p.Dimensions()) % p.Dimensions()
+		currentAxis = (currentAxis - 1 + dims) % dims
 	}
 	return nearest, shortest
 }
 
-// sqDiff returns the squared-difference of x and y, shifted by 2 so that
-// adding four of those won't overflow A uint32.
-func sqDiff(x, y uint32) uint32 {
-	// The canonical code of this function looks as follows:
-	//
-	//	var d uint32
-	//	if x > y {
-	//		d = x - y
-	//	} else {
-	//		d = y - x
-	//	}
-	//	return (d * d) >> 2
-	//
-	// Language spec guarantees the following properties of unsigned integer
-	// values operations with respect to overflow/wrap around:
-	//
-	// > For unsigned integer values, the operations +, -, *, and << are
-	// > computed modulo 2n, where n is the bit width of the unsigned
-	// > integer's type. Loosely speaking, these unsigned integer operations
-	// > discard high bits upon overflow, and programs may rely on ``wrap
-	// > around''.
-	//
-	// Considering these properties and the fact that this function is
-	// called in the hot paths (x,y loops), it is reduced to the below code
-	// which is slightly faster. See TestSqDiff for correctness check.
-	d := x - y
-	return (d * d) >> 2
-}
-
-func squaredDistance(p1, p2 Color) uint32 {
-	var sum uint32 = 0
-	for i := 0; i < p1.Dimensions(); i++ {
-		sum += sqDiff(p1.Dimension(i), p2.Dimension(i))
-	}
-	return sum
-}
-
-func squaredPlaneDistance(p Color, planePosition uint32, dim int) uint32 {
-	return sqDiff(planePosition, p.Dimension(dim))
+// Match is A palette color found by A search, along with its distance from the query color.
+type Match struct {
+	Color       PaletteColor // Color is the matching palette color
+	Distance    float64      // Distance from the query color, as measured by the Metric of the palette
+	RawDistance float64      // RawDistance is the straight-line distance in the 16-bit RGBA space
+	DeltaE      float64      // DeltaE is the perceptual CIEDE2000 difference, where 1 is about A just noticeable difference
+}
+
+// newMatch creates A Match of the palette color c found at distance d from the query p.
+func newMatch(p Color, c PaletteColor, d float64) Match {
+	return Match{
+		Color:       c,
+		Distance:    d,
+		RawDistance: EuclideanRGB.Distance(EuclideanRGB.Project(p), EuclideanRGB.Project(c)),
+		DeltaE:      CIEDE2000.Distance(CIEDE2000.Project(p), CIEDE2000.Project(c)),
+	}
+}
+
+// complete fills in the distances of the matches found for the query p, which the searches leave out.
+func complete(p Color, matches []Match) []Match {
+	for i, m := range matches {
+		matches[i] = newMatch(p, m.Color, m.Distance)
+	}
+	return matches
+}
+
+// KNearest finds the k closest palette colors to the given color, closest first.
+// Returns all the palette colors if the palette has less than k colors.
+func (t *Palette) KNearest(p Color, k int) []Match {
+	if t.root == nil || p == nil || k <= 0 {
+		return nil
+	}
+	if k > len(t.lookup) {
+		k = len(t.lookup)
+	}
+	h := make(matchHeap, 0, k+1)
+	knn(t.metric, t.metric.Project(p), t.root, 0, k, &h)
+	matches := []Match(h)
+	sortMatches(matches)
+	return complete(p, matches)
+}
+
+// knn implements the k-nearest neighbour search in A kd-tree, collecting the k closest colors into h.
+func knn(m Metric, p Point, n *node, axis, k int, h *matchHeap) {
+	if n == nil {
+		return
+	}
+	nextAxis := (axis + 1) % n.point.N
+	near, far := n.Left, n.Right
+	if p.X[axis] >= n.point.X[axis] {
+		near, far = far, near
+	}
+	knn(m, p, near, nextAxis, k, h)
+
+	if d := m.Distance(p, n.point); h.Len() < k || d < h.farthest() {
+		heap.Push(h, Match{Color: n.PaletteColor, Distance: d})
+		if h.Len() > k {
+			heap.Pop(h)
+		}
+	}
+
+	// check other side of plane
+	if h.Len() < k || m.PlaneDistance(p, n.point.X[axis], axis) < h.farthest() {
+		knn(m, p, far, nextAxis, k, h)
+	}
+}
+
+// WithinDistance finds all the palette colors within maxDist of the given color, closest first.
+// Distances are measured by the Metric of the palette.
+func (t *Palette) WithinDistance(p Color, maxDist float64) []Match {
+	if t.root == nil || p == nil || maxDist < 0 {
+		return nil
+	}
+	var matches []Match
+	rangeSearch(t.metric, t.metric.Project(p), t.root, 0, maxDist, &matches)
+	sortMatches(matches)
+	return complete(p, matches)
+}
+
+// rangeSearch implements the range search in A kd-tree, collecting every color within maxDist into matches.
+func rangeSearch(m Metric, p Point, n *node, axis int, maxDist float64, matches *[]Match) {
+	if n == nil {
+		return
+	}
+	nextAxis := (axis + 1) % n.point.N
+	near, far := n.Left, n.Right
+	if p.X[axis] >= n.point.X[axis] {
+		near, far = far, near
+	}
+	rangeSearch(m, p, near, nextAxis, maxDist, matches)
+	if d := m.Distance(p, n.point); d <= maxDist {
+		*matches = append(*matches, Match{Color: n.PaletteColor, Distance: d})
+	}
+
+	// check other side of plane
+	if m.PlaneDistance(p, n.point.X[axis], axis) <= maxDist {
+		rangeSearch(m, p, far, nextAxis, maxDist, matches)
+	}
+}
+
+// matchHeap heap.Interface implementation keeping the farthest Match on top.
+type matchHeap []Match
+
+func (h matchHeap) Len() int {
+	return len(h)
+}
+func (h matchHeap) Less(i, j int) bool {
+	return h[i].Distance > h[j].Distance
+}
+func (h matchHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h *matchHeap) Push(x interface{}) {
+	*h = append(*h, x.(Match))
+}
+func (h *matchHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+func (h matchHeap) farthest() float64 {
+	return h[0].Distance
+}
+
+// sortMatches sorts the matches closest first, breaking ties by palette index.
+func sortMatches(matches []Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Color.Index() < matches[j].Color.Index()
+	})
 }
 
 func popLast(arr []*node) ([]*node, *node) {
@@ -166,28 +344,47 @@ func popLast(arr []*node) ([]*node, *node) {
 // byDimension sort.Interface Implementation for dimension-wise sorting
 type byDimension struct {
 	dimension int
-	points    []PaletteColor
+	points    []node
 }
 
 func (b *byDimension) Len() int {
 	return len(b.points)
 }
 func (b *byDimension) Less(i, j int) bool {
-	return b.points[i].Dimension(b.dimension) < b.points[j].Dimension(b.dimension)
+	return b.points[i].point.X[b.dimension] < b.points[j].point.X[b.dimension]
 }
 func (b *byDimension) Swap(i, j int) {
 	b.points[i], b.points[j] = b.points[j], b.points[i]
 }
 
+// project projects A palette color into A point of the kd-tree by the metric, leaving out its alpha unless the
+// palette has alpha, so that translucent colors of A palette without alpha are searched like the others.
+func project(m Metric, c Color, alpha bool) Point {
+	p := m.Project(c)
+	if !alpha && p.N > 3 {
+		p.N, p.X[3] = 3, 0
+	}
+	return p
+}
+
 // NewPalette creates A new palette directly from A list of PaletteColor
-func NewPalette(colors []PaletteColor, alpha bool) *Palette {
-	t := make(map[int]PaletteColor)
-	for _, c := range colors {
-		t[c.Index()] = c
+// alpha if false, ignores transparency(A) values of the colors converted through the color.Model.
+func NewPalette(colors []PaletteColor, alpha bool, opts ...Option) *Palette {
+	p := &Palette{
+		alpha:    alpha,
+		metric:   EuclideanRGB,
+		limit:    math.Inf(1),
+		fallback: color.Transparent,
+		lookup:   make(map[int]PaletteColor),
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
-	return &Palette{
-		alpha:  alpha,
-		root:   newColorTree(colors, 0),
-		lookup: t,
+	nodes := make([]node, len(colors))
+	for i, c := range colors {
+		p.lookup[c.Index()] = c
+		nodes[i] = node{PaletteColor: c, point: project(p.metric, c, alpha)}
 	}
+	p.root = newColorTree(nodes, 0)
+	return p
 }
@@ -17,11 +17,15 @@
 package treepalette_test
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/philoj/tree-palette"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"image/color"
 	"math"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -83,6 +87,197 @@ func TestTreePalette_ConvertColorRandomNoAlpha(t *testing.T) {
 		})
 	}
 }
+func TestTreePalette_ConvertColorMetrics(t *testing.T) {
+	metrics := map[string]treepalette.Metric{
+		"EuclideanRGB": treepalette.EuclideanRGB,
+		"CIE76":        treepalette.CIE76,
+		"CIE94":        treepalette.CIE94,
+		"CIEDE2000":    treepalette.CIEDE2000,
+		"Oklab":        treepalette.Oklab,
+	}
+	for name, m := range metrics {
+		for _, alpha := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s alpha:%v", name, alpha), func(t *testing.T) {
+				rand.Seed(42)
+				colors := randomPalette(64, alpha)
+				p := treepalette.NewPalette(colors, alpha, treepalette.WithMetric(m))
+				for i := 0; i < 200; i++ {
+					c := randomColor(alpha)
+					assert.Equal(t, closestIndexByMetric(m, c, colors), p.ConvertColor(c).Index())
+				}
+			})
+		}
+	}
+}
+
+func TestTreePalette_KNearest(t *testing.T) {
+	rand.Seed(3)
+	colors := randomPalette(50, true)
+	p := treepalette.NewPalette(colors, true, treepalette.WithMetric(treepalette.CIE76))
+	for i := 0; i < 50; i++ {
+		c := randomColor(true)
+		matches := p.KNearest(c, 5)
+		assert.Len(t, matches, 5)
+		assert.Equal(t, closestIndexByMetric(treepalette.CIE76, c, colors), matches[0].Color.Index())
+
+		// no palette color outside the result may be closer than the last match
+		q := treepalette.CIE76.Project(c)
+		found := make(map[int]bool)
+		for j, m := range matches {
+			found[m.Color.Index()] = true
+			if j > 0 {
+				assert.LessOrEqual(t, matches[j-1].Distance, m.Distance)
+			}
+		}
+		for _, cc := range colors {
+			if !found[cc.Index()] {
+				assert.GreaterOrEqual(t, treepalette.CIE76.Distance(q, treepalette.CIE76.Project(cc)), matches[4].Distance)
+			}
+		}
+	}
+	assert.Len(t, p.KNearest(randomColor(true), 100), 50)
+	assert.Len(t, p.KNearest(randomColor(true), int(^uint(0)>>1)), 50) // max int
+	assert.Nil(t, p.KNearest(randomColor(true), 0))
+}
+
+func TestTreePalette_WithinDistance(t *testing.T) {
+	rand.Seed(5)
+	colors := randomPalette(100, false)
+	p := treepalette.NewPalette(colors, false, treepalette.WithMetric(treepalette.CIEDE2000))
+	for i := 0; i < 50; i++ {
+		c := randomColor(false)
+		maxDist := rand.Float64() * 30
+		q := treepalette.CIEDE2000.Project(c)
+		var expected []int
+		for _, cc := range colors {
+			if treepalette.CIEDE2000.Distance(q, treepalette.CIEDE2000.Project(cc)) <= maxDist {
+				expected = append(expected, cc.Index())
+			}
+		}
+		var actual []int
+		matches := p.WithinDistance(c, maxDist)
+		for j, m := range matches {
+			actual = append(actual, m.Color.Index())
+			assert.LessOrEqual(t, m.Distance, maxDist)
+			if j > 0 {
+				assert.LessOrEqual(t, matches[j-1].Distance, m.Distance)
+			}
+		}
+		assert.ElementsMatch(t, expected, actual)
+	}
+}
+
+func TestTreePalette_ConvertColorWithDistance(t *testing.T) {
+	p := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(255, 0, 0, 1, "RED"),
+		treepalette.NewOpaquePaletteColor(0, 0, 255, 2, "BLUE"),
+	}, false, treepalette.WithMetric(treepalette.CIE76))
+
+	m := p.ConvertColorWithDistance(treepalette.NewOpaqueColor(255, 0, 0))
+	assert.Equal(t, 1, m.Color.Index())
+	assert.Zero(t, m.Distance)
+	assert.Zero(t, m.RawDistance)
+	assert.Zero(t, m.DeltaE)
+
+	m = p.ConvertColorWithDistance(treepalette.NewOpaqueColor(255, 0, 1))
+	assert.Equal(t, 1, m.Color.Index())
+	assert.InDelta(t, 257, m.RawDistance, 1)
+	assert.Greater(t, m.Distance, 0.0)
+	assert.Greater(t, m.DeltaE, 0.0)
+
+	assert.Nil(t, treepalette.NewPalette(nil, false).ConvertColorWithDistance(treepalette.NewOpaqueColor(1, 2, 3)).Color)
+}
+
+func TestTreePalette_Mutations(t *testing.T) {
+	rand.Seed(11)
+	colors := randomPalette(20, false)
+	p := treepalette.NewPalette(colors, false)
+	current := make(map[int]treepalette.PaletteColor)
+	for _, c := range colors {
+		current[c.Index()] = c
+	}
+
+	// insert many colors in sorted order, which degrades the tree unless it's rebalanced
+	for i := 20; i < 500; i++ {
+		c := &treepalette.IndexedColorRGBA{ColorRGBA: treepalette.NewOpaqueColor(i%256, i%256, i/256), Id: i}
+		assert.NoError(t, p.Insert(c))
+		current[i] = c
+	}
+	assert.Error(t, p.Insert(colors[0]))
+	for i := 0; i < 500; i += 3 {
+		assert.NoError(t, p.Remove(i))
+		delete(current, i)
+	}
+	assert.Error(t, p.Remove(0))
+	for i := 1; i < 500; i += 6 {
+		c := &treepalette.IndexedColorRGBA{ColorRGBA: randomColor(false), Id: i}
+		assert.NoError(t, p.Update(i, c))
+		current[i] = c
+	}
+	assert.Error(t, p.Update(0, colors[0]))
+	assert.Error(t, p.Update(1, colors[2]))
+
+	var remaining []treepalette.PaletteColor
+	for _, c := range current {
+		remaining = append(remaining, c)
+	}
+	for i := 0; i < 200; i++ {
+		c := randomColor(false)
+		// compare distances, since equally close colors may be picked either way
+		q := treepalette.EuclideanRGB.Project(c)
+		expected := treepalette.EuclideanRGB.Distance(q, treepalette.EuclideanRGB.Project(current[closestIndex(c, remaining)]))
+		assert.Equal(t, expected, treepalette.EuclideanRGB.Distance(q, treepalette.EuclideanRGB.Project(p.ConvertColor(c))))
+	}
+	for _, c := range remaining {
+		assert.Equal(t, c.Index(), p.KNearest(c, 1)[0].Color.Index())
+	}
+}
+
+func TestCIEDE2000(t *testing.T) {
+	// reference values from Sharma, Wu and Dalal, "The CIEDE2000 Color-Difference Formula"
+	tests := []struct {
+		lab1, lab2 [3]float64
+		distance   float64
+	}{
+		{[3]float64{50, 2.6772, -79.7751}, [3]float64{50, 0, -82.7485}, 2.0425},
+		{[3]float64{50, -1.3802, -84.2814}, [3]float64{50, 0, -82.7485}, 1.0000},
+		{[3]float64{50, 2.5, 0}, [3]float64{73, 25, -18}, 27.1492},
+		{[3]float64{60.2574, -34.0099, 36.2677}, [3]float64{60.4626, -34.1751, 39.4387}, 1.2644},
+		{[3]float64{22.7233, 20.0904, -46.694}, [3]float64{23.0331, 14.973, -42.5619}, 2.0373},
+		{[3]float64{2.0776, 0.0795, -1.135}, [3]float64{0.9033, -0.0636, -0.5514}, 0.9082},
+	}
+	for _, test := range tests {
+		q := treepalette.Point{X: [4]float64{test.lab1[0], test.lab1[1], test.lab1[2]}, N: 3}
+		p := treepalette.Point{X: [4]float64{test.lab2[0], test.lab2[1], test.lab2[2]}, N: 3}
+		assert.InDelta(t, test.distance, treepalette.CIEDE2000.Distance(q, p), 1e-4)
+	}
+}
+
+func TestColorOklab(t *testing.T) {
+	rand.Seed(7)
+	for i := 0; i < 100; i++ {
+		c := randomColor(false)
+		o := treepalette.ToOklab(c)
+		for d := 0; d < 3; d++ {
+			assert.InDelta(t, c.Dimension(d), o.Dimension(d), 2)
+		}
+		L, C, h := o.LCh()
+		assert.InDelta(t, o.A, treepalette.NewOklchColor(L, C, h).A, 1e-9)
+
+		// the metrics project the same dimensions as Dimension reports
+		o.Alpha, o.AlphaChannel = 0.5, i%2 == 0
+		rgba := treepalette.ColorRGBA{R: o.Dimension(0), G: o.Dimension(1), B: o.Dimension(2), A: 0xffff, AlphaChannel: o.AlphaChannel}
+		if o.AlphaChannel {
+			rgba.A = o.Dimension(3)
+		}
+		for _, m := range []treepalette.Metric{treepalette.EuclideanRGB, treepalette.CIE76} {
+			assert.Equal(t, m.Project(rgba), m.Project(o))
+		}
+	}
+	white := treepalette.ToOklab(treepalette.NewOpaqueColor(255, 255, 255))
+	assert.InDelta(t, 1, white.L, 1e-4)
+	assert.InDelta(t, 0, white.A, 1e-4)
+}
 
 // Helper functions
 
@@ -120,3 +315,209 @@ func closestIndex(c treepalette.Color, p []treepalette.PaletteColor) int {
 	}
 	return result
 }
+
+func closestIndexByMetric(m treepalette.Metric, c treepalette.Color, p []treepalette.PaletteColor) int {
+	minD := math.Inf(1)
+	var result int
+	q := m.Project(c)
+	for _, cc := range p {
+		if d := m.Distance(q, m.Project(cc)); d < minD {
+			minD, result = d, cc.Index()
+		}
+	}
+	return result
+}
+
+func TestSyncPalette(t *testing.T) {
+	rand.Seed(13)
+	colors := randomPalette(30, false)
+	s := treepalette.NewSyncPalette(treepalette.NewPalette(colors, false))
+	original := s.Load()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				assert.NotNil(t, s.ConvertColor(treepalette.NewOpaqueColor(j%256, 0, 0)))
+			}
+		}()
+	}
+	for i := 30; i < 60; i++ {
+		c := treepalette.NewOpaquePaletteColor(i, i, i, i, "GREY")
+		assert.NoError(t, s.Edit(func(p *treepalette.Palette) error {
+			return p.Insert(c)
+		}))
+	}
+	wg.Wait()
+
+	assert.Error(t, s.Edit(func(p *treepalette.Palette) error {
+		return p.Remove(1000)
+	}))
+	assert.Equal(t, 45, s.ConvertColor(treepalette.NewOpaqueColor(45, 45, 45)).Index())
+	assert.NotEqual(t, 45, original.ConvertColor(treepalette.NewOpaqueColor(45, 45, 45)).Index())
+}
+
+func TestTreePalette_MarshalBinary(t *testing.T) {
+	rand.Seed(29)
+	colors := randomPalette(500, true)
+	oklab := treepalette.NewOklabPaletteColor(0.5, 0.1, -0.1, 500, "oklab")
+	oklab.AlphaChannel = true
+	colors = append(colors, oklab, treepalette.NewTransparentPaletteColor(1, 2, 3, 0.5, 501, "named"))
+	p := treepalette.NewPalette(colors, true, treepalette.WithMetric(treepalette.CIE76),
+		treepalette.WithThreshold(30, treepalette.NewOpaqueColor(1, 2, 3)))
+	assert.NoError(t, p.Remove(7))
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+
+	loaded := treepalette.NewPalette(nil, false, treepalette.WithCache(64))
+	assert.NoError(t, loaded.UnmarshalBinary(data))
+	assert.Equal(t, p.Indexes(), loaded.Indexes())
+	for i := 0; i < 1000; i++ {
+		c := randomColor(true)
+		expected, actual := p.ConvertColorWithDistance(c), loaded.ConvertColorWithDistance(c)
+		assert.Equal(t, expected.Distance, actual.Distance)
+		if expected.Color != nil {
+			assert.Equal(t, expected.Color.Index(), actual.Color.Index())
+		}
+		assert.Equal(t, color.RGBA64Model.Convert(p.Convert(c)), color.RGBA64Model.Convert(loaded.Convert(c)))
+	}
+	assert.Equal(t, colors[500], loaded.ConvertColor(colors[500]))
+	assert.Equal(t, colors[501], loaded.ConvertColor(colors[501]))
+	assert.NotZero(t, loaded.CacheStats().Hits)
+	again, err := loaded.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, data, again)
+
+	empty, err := treepalette.NewPalette(nil, false).MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, loaded.UnmarshalBinary(empty))
+	assert.Empty(t, loaded.Indexes())
+	assert.Nil(t, loaded.ConvertColor(randomColor(false)))
+
+	for i := range data {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x40
+		assert.Error(t, loaded.UnmarshalBinary(corrupt), "byte %d", i)
+	}
+	assert.Error(t, loaded.UnmarshalBinary(data[:len(data)-1]))
+	assert.Empty(t, loaded.Indexes()) // left as it was
+
+	_, err = treepalette.NewPalette(colors, false, treepalette.WithMetric(customMetric{treepalette.EuclideanRGB})).MarshalBinary()
+	assert.Error(t, err)
+	_, err = treepalette.NewPalette([]treepalette.PaletteColor{otherColor{}}, false).MarshalBinary()
+	assert.Error(t, err)
+}
+
+func TestTreePalette_UnmarshalBinary(t *testing.T) {
+	const (
+		left, right, alpha = 1, 2, 4
+	)
+	// node encodes A node of the given flags and RGBA values
+	node := func(flags byte, id int, v ...uint16) []byte {
+		var buf [binary.MaxVarintLen64]byte
+		data := append([]byte{flags}, buf[:binary.PutVarint(buf[:], int64(id))]...)
+		data = append(data, 0) // no name
+		for _, x := range append(v, 0xffff) {
+			data = append(data, byte(x), byte(x>>8))
+		}
+		return data
+	}
+	// encode encodes A palette of the nodes in pre-order
+	encode := func(alphaPalette bool, nodes ...[]byte) []byte {
+		data := append([]byte("TPKD\x01\x00\x0deuclidean-rgb"), 0, 0, 0, 0, 0, 0, 0xf0, 0x7f) // no threshold
+		data = append(data, make([]byte, 8)...)
+		if alphaPalette {
+			data[5] = 1
+		}
+		data = append(data, byte(len(nodes)), 0, 0, 0)
+		for _, n := range nodes {
+			data = append(data, n...)
+		}
+		sum := crc32.ChecksumIEEE(data)
+		return append(data, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24))
+	}
+	p := treepalette.NewPalette(nil, false)
+
+	assert.NoError(t, p.UnmarshalBinary(encode(false, node(left|right, 0, 128, 128, 128), node(0, 1, 64, 0, 0), node(0, 2, 200, 0, 0))))
+	assert.Equal(t, []int{0, 1, 2}, p.Indexes())
+	assert.Equal(t, 2, p.ConvertColor(treepalette.NewOpaqueColor(210, 0, 0)).Index())
+
+	// children on the wrong side of their parent, or of an ancestor
+	assert.Error(t, p.UnmarshalBinary(encode(false, node(left, 0, 128, 128, 128), node(0, 1, 200, 0, 0))))
+	assert.Error(t, p.UnmarshalBinary(encode(false, node(right, 0, 128, 128, 128), node(left, 1, 200, 128, 0), node(0, 2, 100, 100, 0))))
+	assert.NoError(t, p.UnmarshalBinary(encode(false, node(right, 0, 128, 128, 128), node(left, 1, 200, 128, 0), node(0, 2, 150, 100, 0))))
+
+	// colors with and without alpha, which palettes without alpha search alike
+	assert.Error(t, p.UnmarshalBinary(encode(true, node(alpha|right, 0, 128, 128, 128), node(0, 1, 200, 200, 200))))
+	assert.Error(t, p.UnmarshalBinary(encode(true, node(right, 0, 128, 128, 128), node(alpha, 1, 200, 200, 200))))
+	assert.NoError(t, p.UnmarshalBinary(encode(false, node(alpha|right, 0, 128, 128, 128), node(0, 1, 200, 200, 200))))
+	assert.NoError(t, p.UnmarshalBinary(encode(true, node(alpha, 0, 128, 128, 128))))
+	_, err := treepalette.NewPalette([]treepalette.PaletteColor{
+		treepalette.NewOpaquePaletteColor(1, 2, 3, 0, ""),
+		treepalette.NewTransparentPaletteColor(1, 2, 3, 0.5, 1, ""),
+	}, true).MarshalBinary()
+	assert.Error(t, err)
+
+	// translucent colors of A palette without alpha are kept as they are
+	colors := []treepalette.PaletteColor{
+		treepalette.NewTransparentPaletteColor(200, 0, 0, 0.5, 0, "translucent"),
+		treepalette.NewOpaquePaletteColor(0, 0, 200, 1, "opaque"),
+	}
+	for i := 2; i < 100; i++ {
+		colors = append(colors, treepalette.NewTransparentPaletteColor(rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Float64(), i, ""))
+	}
+	p = treepalette.NewPalette(colors, false)
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	loaded := treepalette.NewPalette(nil, true)
+	assert.NoError(t, loaded.UnmarshalBinary(data))
+	assert.Equal(t, colors[0], loaded.ConvertColor(treepalette.NewOpaqueColor(200, 0, 0)))
+	for i := 0; i < 1000; i++ {
+		c := randomColor(false)
+		assert.Equal(t, p.ConvertColorWithDistance(c), loaded.ConvertColorWithDistance(c))
+		assert.Equal(t, p.Convert(c), loaded.Convert(c))
+	}
+
+	// chains of right children
+	chain := func(length int) [][]byte {
+		nodes := make([][]byte, length)
+		for i := range nodes {
+			nodes[i] = node(right, i, uint16(i), uint16(i), uint16(i))
+		}
+		nodes[length-1][0] = 0
+		return nodes
+	}
+	assert.NoError(t, p.UnmarshalBinary(encode(false, chain(8)...)))
+	assert.Error(t, p.UnmarshalBinary(encode(false, chain(200)...)))
+
+	// trees left deep by removals are rebalanced
+	rand.Seed(37)
+	p = treepalette.NewPalette(nil, false)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, p.Insert(treepalette.NewOpaquePaletteColor(i%256, i/4, 255-i%256, i, "")))
+	}
+	for i := 0; i < 990; i++ {
+		assert.NoError(t, p.Remove(i))
+	}
+	data, err = p.MarshalBinary()
+	assert.NoError(t, err)
+	loaded = treepalette.NewPalette(nil, false)
+	assert.NoError(t, loaded.UnmarshalBinary(data))
+	assert.Equal(t, p.Indexes(), loaded.Indexes())
+}
+
+// customMetric A Metric outside the package.
+type customMetric struct {
+	treepalette.Metric
+}
+
+// otherColor A PaletteColor outside the package.
+type otherColor struct {
+	treepalette.ColorRGBA
+}
+
+func (otherColor) Index() int {
+	return 0
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2021 Philoj Johny
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain A copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ */
+package treepalette
+
+import "image"
+
+// wuSide the number of cells per channel of the Wu histogram, 5 bits of each channel plus an empty row.
+const wuSide = 33
+
+// Wu generates A palette of opaque colors by Xiaolin Wu's quantizer, repeatedly splitting the box of colors
+// with the largest variance where the split minimizes the sum of the variances of the two halves.
+// Works on A histogram of 5 bits per channel, each box making one color, the mean of its pixels.
+// See: Xiaolin Wu, Efficient Statistical Computations for Optimal Color Quantization, Graphics Gems II.
+type Wu struct{}
+
+// Quantize generates at most n opaque colors from the pixels of the images, ready for NewPalette without alpha.
+// Colors are ordered by the number of pixels they stand for, most first, and indexed from 0 in that order.
+// Fully transparent pixels are left out.
+func (Wu) Quantize(n int, images ...image.Image) []PaletteColor {
+	bins := histogram(images, false)
+	if n < 1 || len(bins) == 0 {
+		return nil
+	}
+	m := newWuMoments(bins)
+
+	boxes := []wuBox{{r1: wuSide - 1, g1: wuSide - 1, b1: wuSide - 1}}
+	variances := []float64{0}
+	for next := 0; len(boxes) < n; {
+		if second, ok := m.cut(&boxes[next]); ok {
+			boxes = append(boxes, second)
+			variances[next] = m.variance(boxes[next])
+			variances = append(variances, m.variance(second))
+		} else {
+			variances[next] = 0
+		}
+		next = 0
+		for i, v := range variances {
+			if v > variances[next] {
+				next = i
+			}
+		}
+		if variances[next] <= 0 {
+			break // no box can be split any further
+		}
+	}
+
+	var counts []int
+	var values [][4]float64
+	for _, b := range boxes {
+		if w := m.volume(b, &m.w); w > 0 {
+			counts = append(counts, int(w+0.5))
+			values = append(values, [4]float64{m.volume(b, &m.r) / w, m.volume(b, &m.g) / w, m.volume(b, &m.b) / w, 0xffff})
+		}
+	}
+	return byCount(counts, values, false)
+}
+
+// wuBox A box of cells in the Wu histogram, from the exclusive lower bounds to the inclusive upper bounds.
+type wuBox struct {
+	r0, r1, g0, g1, b0, b1 int
+}
+
+// cells returns the number of cells in the box.
+func (b wuBox) cells() int {
+	return (b.r1 - b.r0) * (b.g1 - b.g0) * (b.b1 - b.b0)
+}
+
+// wuCells A value for each cell of the Wu histogram.
+type wuCells [wuSide * wuSide * wuSide]float64
+
+// wuMoments the cumulative moments of the Wu histogram: each cell holds the sum over all the cells up to it.
+type wuMoments struct {
+	w, r, g, b, sq wuCells // w pixel counts, r g b sums of the channels, sq sums of the squared channels
+}
+
+func newWuMoments(bins []bin) *wuMoments {
+	m := &wuMoments{}
+	for _, h := range bins {
+		v := h.mean()
+		i := wuIndex(int(v[0])>>11+1, int(v[1])>>11+1, int(v[2])>>11+1)
+		m.w[i] += float64(h.count)
+		m.r[i] += h.sum[0]
+		m.g[i] += h.sum[1]
+		m.b[i] += h.sum[2]
+		m.sq[i] += float64(h.count) * (v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+	}
+	for _, c := range []*wuCells{&m.w, &m.r, &m.g, &m.b, &m.sq} {
+		for r := 1; r < wuSide; r++ {
+			var area [wuSide]float64
+			for g := 1; g < wuSide; g++ {
+				var line float64
+				for b := 1; b < wuSide; b++ {
+					i := wuIndex(r, g, b)
+					line += c[i]
+					area[b] += line
+					c[i] = c[wuIndex(r-1, g, b)] + area[b]
+				}
+			}
+		}
+	}
+	return m
+}
+
+func wuIndex(r, g, b int) int {
+	return (r*wuSide+g)*wuSide + b
+}
+
+// volume sums the moment over the box.
+func (m *wuMoments) volume(b wuBox, c *wuCells) float64 {
+	return c[wuIndex(b.r1, b.g1, b.b1)] - c[wuIndex(b.r1, b.g1, b.b0)] -
+		c[wuIndex(b.r1, b.g0, b.b1)] + c[wuIndex(b.r1, b.g0, b.b0)] -
+		c[wuIndex(b.r0, b.g1, b.b1)] + c[wuIndex(b.r0, b.g1, b.b0)] +
+		c[wuIndex(b.r0, b.g0, b.b1)] - c[wuIndex(b.r0, b.g0, b.b0)]
+}
+
+// bottom sums the moment over the box with its upper bound on the given axis moved to its lower bound,
+// the part of volume which doesn't depend on the position of A cut.
+func (m *wuMoments) bottom(b wuBox, axis int, c *wuCells) float64 {
+	switch axis {
+	case 0:
+		return -c[wuIndex(b.r0, b.g1, b.b1)] + c[wuIndex(b.r0, b.g1, b.b0)] +
+			c[wuIndex(b.r0, b.g0, b.b1)] - c[wuIndex(b.r0, b.g0, b.b0)]
+	case 1:
+		return -c[wuIndex(b.r1, b.g0, b.b1)] + c[wuIndex(b.r1, b.g0, b.b0)] +
+			c[wuIndex(b.r0, b.g0, b.b1)] - c[wuIndex(b.r0, b.g0, b.b0)]
+	default:
+		return -c[wuIndex(b.r1, b.g1, b.b0)] + c[wuIndex(b.r1, b.g0, b.b0)] +
+			c[wuIndex(b.r0, b.g1, b.b0)] - c[wuIndex(b.r0, b.g0, b.b0)]
+	}
+}
+
+// top sums the moment over the box with its upper bound on the given axis moved to pos, less bottom.
+func (m *wuMoments) top(b wuBox, axis, pos int, c *wuCells) float64 {
+	switch axis {
+	case 0:
+		return c[wuIndex(pos, b.g1, b.b1)] - c[wuIndex(pos, b.g1, b.b0)] -
+			c[wuIndex(pos, b.g0, b.b1)] + c[wuIndex(pos, b.g0, b.b0)]
+	case 1:
+		return c[wuIndex(b.r1, pos, b.b1)] - c[wuIndex(b.r1, pos, b.b0)] -
+			c[wuIndex(b.r0, pos, b.b1)] + c[wuIndex(b.r0, pos, b.b0)]
+	default:
+		return c[wuIndex(b.r1, b.g1, pos)] - c[wuIndex(b.r1, b.g0, pos)] -
+			c[wuIndex(b.r0, b.g1, pos)] + c[wuIndex(b.r0, b.g0, pos)]
+	}
+}
+
+// variance returns the sum of the squared distances of the pixels in the box from their mean,
+// or 0 if the box is A single cell which can't be split.
+func (m *wuMoments) variance(b wuBox) float64 {
+	w := m.volume(b, &m.w)
+	if b.cells() <= 1 || w == 0 {
+		return 0
+	}
+	r, g, bl := m.volume(b, &m.r), m.volume(b, &m.g), m.volume(b, &m.b)
+	return m.volume(b, &m.sq) - (r*r+g*g+bl*bl)/w
+}
+
+// maximize finds the cut on the given axis which maximizes the sum of the squared sums over the pixel counts
+// of both halves, the same as minimizing the sum of their variances. Returns the score and the cut, -1 if none.
+func (m *wuMoments) maximize(b wuBox, axis, first, last int, whole [4]float64) (float64, int) {
+	base := [4]float64{m.bottom(b, axis, &m.r), m.bottom(b, axis, &m.g), m.bottom(b, axis, &m.b), m.bottom(b, axis, &m.w)}
+	best, cut := 0.0, -1
+	for pos := first; pos < last; pos++ {
+		var half [4]float64
+		for i, c := range []*wuCells{&m.r, &m.g, &m.b, &m.w} {
+			half[i] = base[i] + m.top(b, axis, pos, c)
+		}
+		if half[3] == 0 || half[3] == whole[3] {
+			continue // either half is empty
+		}
+		score := (half[0]*half[0] + half[1]*half[1] + half[2]*half[2]) / half[3]
+		for i := range half {
+			half[i] = whole[i] - half[i]
+		}
+		score += (half[0]*half[0] + half[1]*half[1] + half[2]*half[2]) / half[3]
+		if score > best {
+			best, cut = score, pos
+		}
+	}
+	return best, cut
+}
+
+// cut splits the box in two along the best cut of any axis, shrinking it into the lower half.
+// Returns the upper half, or false if the box can't be split.
+func (m *wuMoments) cut(b *wuBox) (wuBox, bool) {
+	whole := [4]float64{m.volume(*b, &m.r), m.volume(*b, &m.g), m.volume(*b, &m.b), m.volume(*b, &m.w)}
+	bounds := [3][2]int{{b.r0, b.r1}, {b.g0, b.g1}, {b.b0, b.b1}}
+	axis, best, cut := -1, 0.0, -1
+	for a, bound := range bounds {
+		if score, pos := m.maximize(*b, a, bound[0]+1, bound[1], whole); pos >= 0 && (axis < 0 || score > best) {
+			axis, best, cut = a, score, pos
+		}
+	}
+	if axis < 0 {
+		return wuBox{}, false
+	}
+	upper := *b
+	switch axis {
+	case 0:
+		b.r1, upper.r0 = cut, cut
+	case 1:
+		b.g1, upper.g0 = cut, cut
+	default:
+		b.b1, upper.b0 = cut, cut
+	}
+	return upper, true
+}